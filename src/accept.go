@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"log"
+	"time"
+	"strings"
+)
+
+// Acceptor registers the senders not listed in -P on their first valid
+// message, if their address is in one of the allowed networks
+type Acceptor struct {
+	nets []*net.IPNet // nil accepts any address
+	keys KeyRing
+	seals SealRing
+	idle time.Duration
+	peers map[string]*LoadPeer // by ip
+	expired time.Time
+}
+
+// NewAcceptor takes comma separated CIDRs, or "any"
+func NewAcceptor(s string, keys KeyRing, seals SealRing, idle time.Duration) (acc *Acceptor, err error) {
+	acc = &Acceptor{keys:keys, seals:seals, idle:idle, peers:make(map[string]*LoadPeer), expired:time.Now()}
+	if s == "any" { return }
+
+	for _,cidr := range strings.Split(s, ",") {
+		_,ipnet,err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil { return nil, err }
+		acc.nets = append(acc.nets, ipnet)
+	}
+	return
+}
+
+func (acc *Acceptor) Allowed(ip net.IP) bool {
+	if acc.nets == nil { return true }
+	for _,ipnet := range acc.nets {
+		if ipnet.Contains(ip) { return true }
+	}
+	return false
+}
+
+// Peer returns the peer registered for ip, or nil
+func (acc *Acceptor) Peer(ip net.IP) *LoadPeer {
+	peer := acc.peers[ip.String()]
+	if peer != nil { peer.seen = time.Now() }
+	return peer
+}
+
+// Candidate returns a new peer for ip if it is allowed, or nil, it is only
+// registered once its first packet is valid
+func (acc *Acceptor) Candidate(ip net.IP) *LoadPeer {
+	if !acc.Allowed(ip) { return nil }
+	peer := &LoadPeer{name:ip.String(), addr:&net.UDPAddr{IP:ip}, auto:true}
+	peer.key = acc.keys.Key(peer.name)
+	peer.seal = acc.seals.Keys(peer.name)
+	return peer
+}
+
+func (acc *Acceptor) Register(peer *LoadPeer) {
+	peer.seen = time.Now()
+	acc.peers[peer.name] = peer
+	log.Printf("peer %s: registered", peer.name)
+}
+
+// Expire forgets the peers idle for too long and returns them, it scans
+// them at most once a minute
+func (acc *Acceptor) Expire() (expired []*LoadPeer) {
+	if acc.idle <= 0 || time.Since(acc.expired) < time.Minute { return }
+	acc.expired = time.Now()
+
+	for name,peer := range acc.peers {
+		if time.Since(peer.seen) < acc.idle { continue }
+		delete(acc.peers, name)
+		expired = append(expired, peer)
+		log.Printf("peer %s: expired after %v idle", name, time.Since(peer.seen).Round(time.Second))
+	}
+	return
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"time"
+	"testing"
+)
+
+func TestAcceptor(t *testing.T) {
+	if _,err := NewAcceptor("10.0.0.0/8,bad", nil, nil, 0); err == nil { t.Errorf("invalid network accepted") }
+
+	keys := KeyRing{"10.1.2.3":[]byte("0123456789abcdef")}
+	acc, err := NewAcceptor("10.0.0.0/8, fd00::/8", keys, nil, time.Hour)
+	if err != nil { t.Fatal(err) }
+	for ip, want := range map[string]bool{"10.1.2.3":true, "fd00::1":true, "192.168.0.1":false, "fe80::1":false} {
+		if got := acc.Allowed(net.ParseIP(ip)); got != want { t.Errorf("%s: got %v", ip, got) }
+	}
+
+	ip := net.ParseIP("10.1.2.3")
+	if acc.Candidate(net.ParseIP("192.168.0.1")) != nil { t.Errorf("candidate outside the networks") }
+	peer := acc.Candidate(ip)
+	if peer == nil || !peer.auto || peer.name != "10.1.2.3" || peer.key == nil { t.Fatalf("got %v", peer) }
+
+	// candidates are only known once registered
+	if acc.Peer(ip) != nil { t.Errorf("candidate registered") }
+	acc.Register(peer)
+	if acc.Peer(ip) != peer { t.Errorf("peer not registered") }
+
+	acc, _ = NewAcceptor("any", nil, nil, 0)
+	if !acc.Allowed(net.ParseIP("192.168.0.1")) { t.Errorf("address not allowed by any") }
+}
+
+func TestAcceptorExpire(t *testing.T) {
+	acc, _ := NewAcceptor("any", nil, nil, time.Hour)
+	idle := acc.Candidate(net.ParseIP("10.0.0.1"))
+	active := acc.Candidate(net.ParseIP("10.0.0.2"))
+	acc.Register(idle)
+	acc.Register(active)
+	idle.seen = time.Now().Add(-2 * time.Hour)
+
+	// scanned at most once a minute
+	if expired := acc.Expire(); len(expired) != 0 { t.Errorf("expired %v right away", expired) }
+	acc.expired = time.Now().Add(-2 * time.Minute)
+	if expired := acc.Expire(); len(expired) != 1 || expired[0] != idle { t.Errorf("expired %v", expired) }
+	if acc.Peer(idle.addr.IP) != nil || acc.Peer(active.addr.IP) != active { t.Errorf("wrong peers kept") }
+
+	// no expiry without idle time
+	acc.idle = 0
+	acc.expired = time.Time{}
+	active.seen = time.Time{}
+	if expired := acc.Expire(); len(expired) != 0 { t.Errorf("expired %v", expired) }
+}
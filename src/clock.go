@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// the estimates are taken over the last messages of a peer
+	ClockSamples = 64
+	// skew is not reported on fewer messages
+	ClockMinSamples = 8
+)
+
+// ClockStats estimates the clock offset of a peer, and the delay of its
+// messages, from the time they are received minus their source timestamp.
+// The smallest difference is taken as the offset, network and queuing
+// delays only add to it.
+type ClockStats struct {
+	samples [ClockSamples]time.Duration
+	n int
+	skewed bool
+}
+
+func (clock *ClockStats) Add(d time.Duration) {
+	clock.samples[clock.n % ClockSamples] = d
+	clock.n ++
+}
+
+func (clock *ClockStats) count() int {
+	if clock.n < ClockSamples { return clock.n }
+	return ClockSamples
+}
+
+// Offset is the clock of the receiver minus the clock of the peer
+func (clock *ClockStats) Offset() (offset time.Duration) {
+	for i := 0; i < clock.count(); i ++ {
+		if i == 0 || clock.samples[i] < offset { offset = clock.samples[i] }
+	}
+	return
+}
+
+// Delay is the mean delay of the messages above the offset
+func (clock *ClockStats) Delay() time.Duration {
+	var sum time.Duration
+	n := clock.count()
+	if n == 0 { return 0 }
+	for i := 0; i < n; i ++ { sum += clock.samples[i] }
+	return sum / time.Duration(n) - clock.Offset()
+}
+
+// Check logs when the offset of the peer goes beyond threshold, and when
+// it comes back
+func (clock *ClockStats) Check(key string, threshold time.Duration) {
+	if threshold <= 0 || clock.n < ClockMinSamples { return }
+
+	offset := clock.Offset()
+	skewed := offset > threshold || offset < -threshold
+	if skewed && !clock.skewed {
+		log.Printf("peer %s: clock skew %v, delay %v", key, -offset.Round(time.Millisecond), clock.Delay().Round(time.Millisecond))
+	} else if !skewed && clock.skewed {
+		log.Printf("peer %s: clock skew back to %v", key, -offset.Round(time.Millisecond))
+	}
+	clock.skewed = skewed
+}
+
+func DumpClockStats(w io.Writer, clocks map[string]*ClockStats) {
+	keys := make([]string, 0, len(clocks))
+	for key := range clocks { keys = append(keys, key) }
+	sort.Strings(keys)
+
+	for _,key := range keys {
+		clock := clocks[key]
+		fmt.Fprintf(w, "peer %s: clock skew %v, delay %v\n", key,
+			-clock.Offset().Round(time.Millisecond), clock.Delay().Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"time"
+	"bytes"
+	"testing"
+)
+
+func TestClockStats(t *testing.T) {
+	var clock ClockStats
+	if clock.Offset() != 0 || clock.Delay() != 0 { t.Errorf("estimates without samples") }
+
+	// the peer is 2s behind, its messages take 10 to 30ms
+	for i := 0; i < 8; i ++ { clock.Add(2 * time.Second + time.Duration(10 + i % 3 * 10) * time.Millisecond) }
+	if clock.Offset() != 2010 * time.Millisecond { t.Errorf("offset %v", clock.Offset()) }
+	if d := clock.Delay(); d < 8 * time.Millisecond || d > 10 * time.Millisecond { t.Errorf("delay %v", d) }
+
+	clock.Check("web1", time.Second)
+	if !clock.skewed { t.Errorf("skew not reported") }
+
+	// the oldest samples are replaced
+	for i := 0; i < ClockSamples; i ++ { clock.Add(-5 * time.Millisecond) }
+	if clock.Offset() != -5 * time.Millisecond || clock.Delay() != 0 { t.Errorf("offset %v, delay %v", clock.Offset(), clock.Delay()) }
+	clock.Check("web1", time.Second)
+	if clock.skewed { t.Errorf("skew still reported") }
+
+	var w bytes.Buffer
+	DumpClockStats(&w, map[string]*ClockStats{"web1":&clock})
+	if want := "peer web1: clock skew 5ms, delay 0s\n"; w.String() != want { t.Errorf("got %q, want %q", w.String(), want) }
+}
+
+func TestClockCheck(t *testing.T) {
+	var clock ClockStats
+	for i := 0; i < ClockMinSamples - 1; i ++ { clock.Add(time.Hour) }
+	if clock.Check("web1", time.Second); clock.skewed { t.Errorf("skew reported on %d samples", clock.n) }
+	clock.Add(time.Hour)
+	if clock.Check("web1", 0); clock.skewed { t.Errorf("skew reported without threshold") }
+	if clock.Check("web1", time.Second); !clock.skewed { t.Errorf("skew not reported") }
+}
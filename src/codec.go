@@ -3,10 +3,18 @@ package main
 import (
 	"io"
 	"fmt"
+	"time"
 	"bytes"
+	"errors"
+	"io/ioutil"
+	"hash/crc32"
 	"encoding/binary"
 )
 
+var CRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrChecksum = errors.New("checksum mismatch")
+
 func (load *ProcLoad) Encode() (uint8, *bytes.Buffer) {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, load.Uptime_total)
@@ -183,6 +191,273 @@ func (load *NetworkLoad) Decode(splen uint8, r io.Reader) (err error) {
 	return nil
 }
 
+func (load *NUMALoad) Encode() (uint8, *bytes.Buffer) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, load.hugepages_total)
+	binary.Write(buf, binary.BigEndian, load.hugepages_free)
+	binary.Write(buf, binary.BigEndian, load.hugepages_rsvd)
+	binary.Write(buf, binary.BigEndian, uint8(len(load.Items)))
+
+	for _,item := range load.Items {
+		binary.Write(buf, binary.BigEndian, item.node)
+		binary.Write(buf, binary.BigEndian, item.memfree)
+		binary.Write(buf, binary.BigEndian, item.filepages)
+		binary.Write(buf, binary.BigEndian, item.anonpages)
+		binary.Write(buf, binary.BigEndian, item.numa_hit)
+		binary.Write(buf, binary.BigEndian, item.numa_miss)
+	}
+
+	return SPC_NUMALoad, buf
+}
+
+func (load *NUMALoad) Decode(splen uint8, r io.Reader) error {
+	var n uint8
+
+	if splen < 13 { return fmt.Errorf("NUMALoad.Decode: invalid subpacket size (%d)", splen) }
+	binary.Read(r, binary.BigEndian, &load.hugepages_total)
+	binary.Read(r, binary.BigEndian, &load.hugepages_free)
+	binary.Read(r, binary.BigEndian, &load.hugepages_rsvd)
+	binary.Read(r, binary.BigEndian, &n)
+	if int(splen) != 13 + int(n) * 21 { return fmt.Errorf("NUMALoad.Decode: invalid subpacket size (%d)", splen) }
+
+	load.Items = make([]NUMAItem, n)
+	for i := 0; i < int(n); i ++ {
+		binary.Read(r, binary.BigEndian, &load.Items[i].node)
+		binary.Read(r, binary.BigEndian, &load.Items[i].memfree)
+		binary.Read(r, binary.BigEndian, &load.Items[i].filepages)
+		binary.Read(r, binary.BigEndian, &load.Items[i].anonpages)
+		binary.Read(r, binary.BigEndian, &load.Items[i].numa_hit)
+		binary.Read(r, binary.BigEndian, &load.Items[i].numa_miss)
+	}
+
+	return nil
+}
+
+// Cap drops the metrics beyond CustomMaxSize bytes and returns their number
+func (load *CustomLoad) Cap() (dropped int) {
+	size := 0
+	for i,item := range load.Items {
+		if size += 1 + len(item.name) + 8; size > CustomMaxSize {
+			dropped = len(load.Items) - i
+			load.Items = load.Items[:i]
+			break
+		}
+	}
+	return
+}
+
+// custom metrics may not fit in one subpacket, Split cuts them into
+// several ones which are concatenated again by Decode
+func (load *CustomLoad) Split() (chunks []CustomLoad) {
+	var chunk CustomLoad
+	size := 1
+
+	for _,item := range load.Items {
+		itemsize := 1 + len(item.name) + 8
+		if size + itemsize > 255 || len(chunk.Items) == 255 {
+			chunks = append(chunks, chunk)
+			chunk = CustomLoad{}
+			size = 1
+		}
+		chunk.Items = append(chunk.Items, item)
+		size += itemsize
+	}
+	if len(chunk.Items) > 0 { chunks = append(chunks, chunk) }
+
+	return
+}
+
+func (load *CustomLoad) Encode() (uint8, *bytes.Buffer) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint8(len(load.Items)))
+
+	for _,item := range load.Items {
+		binary.Write(buf, binary.BigEndian, uint8(len(item.name)))
+		buf.Write([]byte(item.name))
+		binary.Write(buf, binary.BigEndian, item.value)
+	}
+
+	return SPC_CustomMetrics, buf
+}
+
+func (load *CustomLoad) Decode(splen uint8, r io.Reader) (err error) {
+	var i, num_items, namelen uint8
+
+	err = binary.Read(r, binary.BigEndian, &num_items)
+	if err != nil { return }
+
+	for i = 0; i < num_items; i ++ {
+		var item MetricItem
+		err = binary.Read(r, binary.BigEndian, &namelen)
+		if err != nil { return }
+		namebuf := make([]byte, namelen)
+		_,err = io.ReadFull(r, namebuf)
+		if err != nil { return }
+		item.name = string(namebuf)
+		err = binary.Read(r, binary.BigEndian, &item.value)
+		if err != nil { return }
+		load.Items = append(load.Items, item)
+	}
+
+	return nil
+}
+
+func (t *Timing) Encode() (uint8, *bytes.Buffer) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, t.window_ms)
+	binary.Write(buf, binary.BigEndian, t.delay_ms)
+	binary.Write(buf, binary.BigEndian, t.missed)
+	return SPC_Timing, buf
+}
+
+func (t *Timing) Decode(splen uint8, r io.Reader) error {
+	if splen != 10 { return fmt.Errorf("Timing.Decode: invalid subpacket size (%d)", splen) }
+
+	binary.Read(r, binary.BigEndian, &t.window_ms)
+	binary.Read(r, binary.BigEndian, &t.delay_ms)
+	binary.Read(r, binary.BigEndian, &t.missed)
+
+	return nil
+}
+
+func (st *Status) Encode() (uint8, *bytes.Buffer) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint8(len(st.Items)))
+
+	// share the subpacket among the messages
+	msgmax := 0
+	if len(st.Items) > 0 { msgmax = 254 / len(st.Items) - 2 }
+	for _,item := range st.Items {
+		msg := item.message
+		if len(msg) > msgmax { msg = msg[:msgmax] }
+		binary.Write(buf, binary.BigEndian, item.spcode)
+		binary.Write(buf, binary.BigEndian, uint8(len(msg)))
+		buf.Write([]byte(msg))
+	}
+
+	return SPC_Status, buf
+}
+
+func (st *Status) Decode(splen uint8, r io.Reader) (err error) {
+	var i, num_items, msglen uint8
+
+	err = binary.Read(r, binary.BigEndian, &num_items)
+	if err != nil { return }
+	st.Items = make([]ProbeError, num_items)
+
+	for i = 0; i < num_items; i ++ {
+		err = binary.Read(r, binary.BigEndian, &st.Items[i].spcode)
+		if err != nil { return }
+		err = binary.Read(r, binary.BigEndian, &msglen)
+		if err != nil { return }
+		msgbuf := make([]byte, msglen)
+		_,err = io.ReadFull(r, msgbuf)
+		if err != nil { return }
+		st.Items[i].message = string(msgbuf)
+	}
+
+	return nil
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint8(len(s)))
+	buf.Write([]byte(s))
+}
+
+func readString(r io.Reader) (s string, err error) {
+	var n uint8
+	err = binary.Read(r, binary.BigEndian, &n)
+	if err != nil { return }
+	buf := make([]byte, n)
+	_,err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+func (id *Identity) Encode() (uint8, *bytes.Buffer) {
+	buf := new(bytes.Buffer)
+	writeString(buf, id.hostname)
+	writeString(buf, id.machine_id)
+	binary.Write(buf, binary.BigEndian, uint8(len(id.labels)))
+
+	for _,label := range id.labels {
+		writeString(buf, label.key)
+		writeString(buf, label.value)
+	}
+
+	return SPC_Identity, buf
+}
+
+func (id *Identity) Decode(splen uint8, r io.Reader) (err error) {
+	var i, num_labels uint8
+
+	id.hostname, err = readString(r)
+	if err != nil { return }
+	id.machine_id, err = readString(r)
+	if err != nil { return }
+	err = binary.Read(r, binary.BigEndian, &num_labels)
+	if err != nil { return }
+	id.labels = make([]Label, num_labels)
+
+	for i = 0; i < num_labels; i ++ {
+		id.labels[i].key, err = readString(r)
+		if err != nil { return }
+		id.labels[i].value, err = readString(r)
+		if err != nil { return }
+	}
+
+	return nil
+}
+
+// like custom metrics, the inventory is split into several subpackets
+func (inv *Inventory) Split() (chunks []Inventory) {
+	var chunk Inventory
+	size := 1
+
+	for _,item := range inv.Items {
+		itemsize := 2 + len(item.key) + len(item.value)
+		if size + itemsize > 255 || len(chunk.Items) == 255 {
+			chunks = append(chunks, chunk)
+			chunk = Inventory{}
+			size = 1
+		}
+		chunk.Items = append(chunk.Items, item)
+		size += itemsize
+	}
+	if len(chunk.Items) > 0 { chunks = append(chunks, chunk) }
+
+	return
+}
+
+func (inv *Inventory) Encode() (uint8, *bytes.Buffer) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint8(len(inv.Items)))
+
+	for _,item := range inv.Items {
+		writeString(buf, item.key)
+		writeString(buf, item.value)
+	}
+
+	return SPC_Inventory, buf
+}
+
+func (inv *Inventory) Decode(splen uint8, r io.Reader) (err error) {
+	var i, num_items uint8
+
+	err = binary.Read(r, binary.BigEndian, &num_items)
+	if err != nil { return }
+
+	for i = 0; i < num_items; i ++ {
+		var item InventoryItem
+		item.key, err = readString(r)
+		if err != nil { return }
+		item.value, err = readString(r)
+		if err != nil { return }
+		inv.Items = append(inv.Items, item)
+	}
+
+	return nil
+}
+
 func EncodeSubpacket(sp Subpacket, w io.Writer) error {
 	spcode,buf := sp.Encode()
 	if buf.Len() > 255 { panic("Subpacket size overflow") }
@@ -194,22 +469,49 @@ func EncodeSubpacket(sp Subpacket, w io.Writer) error {
 	return nil
 }
 
-func (m *LoadMessage) Encode(w io.Writer) error {
+func (m *LoadMessage) Encode(out io.Writer) error {
 	var err error
+	w := new(bytes.Buffer)
 
 	// message header
 	binary.Write(w, binary.BigEndian, uint8(MessageVersion))
 	binary.Write(w, binary.BigEndian, m.Timestamp)
 	binary.Write(w, binary.BigEndian, m.Interval)
+	binary.Write(w, binary.BigEndian, m.Timestamp_ms)
+	binary.Write(w, binary.BigEndian, m.Interval_ms)
+	binary.Write(w, binary.BigEndian, m.Boot_id)
+	binary.Write(w, binary.BigEndian, m.Sequence)
+
+	if m.Present[SPC_Identity] {
+		if err = EncodeSubpacket(&m.Identity, w); err != nil { return err }
+	}
 
 	// load data
-	if err = EncodeSubpacket(&m.Proc_load, w); err != nil { return err }
-	if err = EncodeSubpacket(&m.Cpu_load, w); err != nil { return err }
-	if err = EncodeSubpacket(&m.Mem_load, w); err != nil { return err }
-	if err = EncodeSubpacket(&m.Io_load, w); err != nil { return err }
-	if err = EncodeSubpacket(&m.Net_load, w); err != nil { return err }
+	for _,spcode := range ProbeCodes {
+		if !m.Present[spcode] { continue }
+		if spcode == SPC_CustomMetrics {
+			for _,chunk := range m.Custom_load.Split() {
+				if err = EncodeSubpacket(&chunk, w); err != nil { return err }
+			}
+			continue
+		}
+		if err = EncodeSubpacket(m.Subpacket(spcode), w); err != nil { return err }
+	}
+	if m.Present[SPC_Timing] {
+		if err = EncodeSubpacket(&m.Timing, w); err != nil { return err }
+	}
+	if m.Present[SPC_Status] {
+		if err = EncodeSubpacket(&m.Status, w); err != nil { return err }
+	}
+	if m.Present[SPC_Inventory] {
+		for _,chunk := range m.Inventory.Split() {
+			if err = EncodeSubpacket(&chunk, w); err != nil { return err }
+		}
+	}
 
-	return nil
+	binary.Write(w, binary.BigEndian, crc32.Checksum(w.Bytes(), CRCTable))
+	_,err = w.WriteTo(out)
+	return err
 }
 
 func (m *LoadMessage) Decode(r io.Reader) error {
@@ -218,13 +520,54 @@ func (m *LoadMessage) Decode(r io.Reader) error {
 	var version, spcode, splen uint8
 	buf := make([]byte, 1)
 
+	// since version 4 the message ends with its checksum
+	body, err := ioutil.ReadAll(r)
+	if err != nil { return err }
+	if len(body) > 0 && body[0] >= 4 {
+		n = len(body) - 4
+		if n < 1 { return fmt.Errorf("premature message") }
+		if crc32.Checksum(body[:n], CRCTable) != binary.BigEndian.Uint32(body[n:]) { return ErrChecksum }
+		body = body[:n]
+	}
+	r = bytes.NewReader(body)
+
 	err = binary.Read(r, binary.BigEndian, &version)
 	if err != nil { return err }
-	if version != MessageVersion { return fmt.Errorf("version mismatch") }
+	if version < 1 || version > MessageVersion { return fmt.Errorf("version mismatch") }
 	err = binary.Read(r, binary.BigEndian, &m.Timestamp)
 	if err != nil { return err }
 	err = binary.Read(r, binary.BigEndian, &m.Interval)
 	if err != nil { return err }
+	if version >= 2 {
+		err = binary.Read(r, binary.BigEndian, &m.Timestamp_ms)
+		if err != nil { return err }
+		err = binary.Read(r, binary.BigEndian, &m.Interval_ms)
+		if err != nil { return err }
+	} else {
+		m.Timestamp_ms = 0
+		m.Interval_ms = uint32(m.Interval) * 1000
+	}
+	if version >= 3 {
+		err = binary.Read(r, binary.BigEndian, &m.Boot_id)
+		if err != nil { return err }
+		err = binary.Read(r, binary.BigEndian, &m.Sequence)
+		if err != nil { return err }
+	} else {
+		m.Boot_id = 0
+		m.Sequence = 0
+	}
+
+	// counter deltas are per interval
+	interval := time.Duration(m.Interval_ms) * time.Millisecond
+	m.Cpu_load.Interval = interval
+	m.Io_load.Interval = interval
+	m.Net_load.Interval = interval
+	m.Numa_load.Interval = interval
+
+	// subpackets which may be split or absent
+	m.Present = make(map[uint8]bool)
+	m.Custom_load.Items = nil
+	m.Inventory.Items = nil
 
 	for n,err = r.Read(buf); n > 0; n,err = r.Read(buf) {
 		spcode = buf[0]
@@ -251,10 +594,59 @@ func (m *LoadMessage) Decode(r io.Reader) error {
 		case SPC_NetworkLoad:
 			err = m.Net_load.Decode(splen, spreader)
 			if err != nil { return err }
+		case SPC_NUMALoad:
+			err = m.Numa_load.Decode(splen, spreader)
+			if err != nil { return err }
+		case SPC_CustomMetrics:
+			err = m.Custom_load.Decode(splen, spreader)
+			if err != nil { return err }
+		case SPC_Timing:
+			err = m.Timing.Decode(splen, spreader)
+			if err != nil { return err }
+		case SPC_Status:
+			err = m.Status.Decode(splen, spreader)
+			if err != nil { return err }
+		case SPC_Identity:
+			err = m.Identity.Decode(splen, spreader)
+			if err != nil { return err }
+		case SPC_Inventory:
+			err = m.Inventory.Decode(splen, spreader)
+			if err != nil { return err }
 		default:
 			return fmt.Errorf("unknown subpacket code")
 		}
+		m.Present[spcode] = true
 	}
 
 	return nil
 }
+
+// FilterSubpackets copies a message keeping only the given subpackets,
+// the header and the raw subpackets are left as they are
+func FilterSubpackets(body []byte, keep map[uint8]bool) ([]byte, error) {
+	if len(body) == 0 { return nil, fmt.Errorf("premature message") }
+	version := body[0]
+	if version < 1 || version > MessageVersion { return nil, fmt.Errorf("version mismatch") }
+	if version >= 4 {
+		n := len(body) - 4
+		if n < 1 { return nil, fmt.Errorf("premature message") }
+		if crc32.Checksum(body[:n], CRCTable) != binary.BigEndian.Uint32(body[n:]) { return nil, ErrChecksum }
+		body = body[:n]
+	}
+
+	header := 7
+	if version >= 2 { header += 6 }
+	if version >= 3 { header += 12 }
+	if len(body) < header { return nil, fmt.Errorf("premature message") }
+
+	out := append([]byte(nil), body[:header]...)
+	for i := header; i < len(body); {
+		if i + 2 > len(body) || i + 2 + int(body[i+1]) > len(body) { return nil, fmt.Errorf("premature subpacket") }
+		n := 2 + int(body[i+1])
+		if keep[body[i]] { out = append(out, body[i:i+n]...) }
+		i += n
+	}
+
+	if version >= 4 { out = binary.BigEndian.AppendUint32(out, crc32.Checksum(out, CRCTable)) }
+	return out, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"bytes"
+	"testing"
+	"reflect"
+	"strings"
+	"hash/crc32"
+	"encoding/binary"
+)
+
+// rawMessage builds a message body carrying the given raw subpackets
+func rawMessage(subpackets ...[]byte) []byte {
+	var w bytes.Buffer
+	m := LoadMessage{Interval:1, Interval_ms:1000, Boot_id:1, Sequence:1}
+	m.Encode(&w)
+	body := w.Bytes()[:w.Len() - 4]
+	for _,sp := range subpackets { body = append(body, sp...) }
+	return binary.BigEndian.AppendUint32(body, crc32.Checksum(body, CRCTable))
+}
+
+// roundTrip encodes in and decodes it into out
+func roundTrip(t *testing.T, in, out Subpacket) {
+	_,buf := in.Encode()
+	if buf.Len() > 255 { t.Fatalf("subpacket too long: %d", buf.Len()) }
+	if err := out.Decode(uint8(buf.Len()), bytes.NewReader(buf.Bytes())); err != nil { t.Fatal(err) }
+}
+
+func TestNUMALoad(t *testing.T) {
+	in := NUMALoad{hugepages_total:512, hugepages_free:100, hugepages_rsvd:3, Items:[]NUMAItem{
+		{node:0, memfree:1000, filepages:2000, anonpages:3000, numa_hit:40, numa_miss:1},
+		{node:1, memfree:4000, filepages:5000, anonpages:6000, numa_hit:70, numa_miss:0},
+	}}
+	var out NUMALoad
+	roundTrip(t, &in, &out)
+	if out.hugepages_total != 512 || out.hugepages_free != 100 || out.hugepages_rsvd != 3 {
+		t.Errorf("hugepages %d %d %d", out.hugepages_total, out.hugepages_free, out.hugepages_rsvd)
+	}
+	if !reflect.DeepEqual(out.Items, in.Items) { t.Errorf("items %v, want %v", out.Items, in.Items) }
+}
+
+func TestNUMALoadMalformed(t *testing.T) {
+	for _,sp := range [][]byte{
+		// shorter than the hugepages and the count
+		{SPC_NUMALoad, 5, 0, 0, 0, 0, 0},
+		// two nodes announced, one present
+		append([]byte{SPC_NUMALoad, 34, 0,0,0,0, 0,0,0,0, 0,0,0,0, 2}, make([]byte, 21)...),
+	} {
+		var m LoadMessage
+		if err := m.Decode(bytes.NewReader(rawMessage(sp))); err == nil { t.Errorf("subpacket % x decoded", sp) }
+	}
+}
+
+func TestCustomLoadSplit(t *testing.T) {
+	var in LoadMessage
+	in.Present = map[uint8]bool{SPC_CustomMetrics:true}
+	for i := 0; i < 300; i ++ {
+		in.Custom_load.Items = append(in.Custom_load.Items, MetricItem{name:fmt.Sprintf("metric.%d", i), value:float64(i) / 4})
+	}
+	in.Custom_load.Items = append(in.Custom_load.Items, MetricItem{name:strings.Repeat("x", MetricMaxName), value:-1})
+
+	chunks := in.Custom_load.Split()
+	if len(chunks) < 2 { t.Fatalf("%d chunks", len(chunks)) }
+	for _,chunk := range chunks {
+		if _,buf := chunk.Encode(); buf.Len() > 255 { t.Errorf("chunk of %d bytes", buf.Len()) }
+	}
+
+	var w bytes.Buffer
+	var out LoadMessage
+	if err := in.Encode(&w); err != nil { t.Fatal(err) }
+	if err := out.Decode(&w); err != nil { t.Fatal(err) }
+	if !reflect.DeepEqual(out.Custom_load.Items, in.Custom_load.Items) { t.Errorf("items differ after a round trip") }
+}
+
+func TestCustomLoadMalformed(t *testing.T) {
+	for _,sp := range [][]byte{
+		{SPC_CustomMetrics, 0},
+		// two items announced, one present
+		{SPC_CustomMetrics, 11, 2, 1, 'a', 0,0,0,0,0,0,0,0},
+		// name longer than the subpacket
+		{SPC_CustomMetrics, 4, 1, 9, 'a', 'b'},
+		// value cut short
+		{SPC_CustomMetrics, 6, 1, 1, 'a', 0,0,0},
+	} {
+		var m LoadMessage
+		if err := m.Decode(bytes.NewReader(rawMessage(sp))); err == nil { t.Errorf("subpacket % x decoded", sp) }
+	}
+}
+
+func TestTiming(t *testing.T) {
+	in := Timing{window_ms:60012, delay_ms:3, missed:2}
+	var out Timing
+	roundTrip(t, &in, &out)
+	if out != in { t.Errorf("got %v, want %v", out, in) }
+
+	var m LoadMessage
+	sp := []byte{SPC_Timing, 6, 0,0,0,1, 0,0}
+	if err := m.Decode(bytes.NewReader(rawMessage(sp))); err == nil { t.Errorf("short timing subpacket decoded") }
+}
+
+func TestStatus(t *testing.T) {
+	in := Status{Items:[]ProbeError{{SPC_CPULoad, "open /proc/stat: permission denied"}, {SPC_NUMALoad, ""}}}
+	var out Status
+	roundTrip(t, &in, &out)
+	if !reflect.DeepEqual(out, in) { t.Errorf("got %v, want %v", out, in) }
+
+	// long messages share the subpacket
+	long := Status{Items:[]ProbeError{{SPC_ProcLoad, strings.Repeat("a", 300)}, {SPC_IOLoad, strings.Repeat("b", 300)}, {SPC_CustomMetrics, "short"}}}
+	out = Status{}
+	roundTrip(t, &long, &out)
+	if len(out.Items) != 3 || out.Items[2].message != "short" || len(out.Items[0].message) != 254 / 3 - 2 {
+		t.Errorf("got %v", out.Items)
+	}
+}
+
+func TestStatusMalformed(t *testing.T) {
+	for _,sp := range [][]byte{
+		{SPC_Status, 0},
+		{SPC_Status, 3, 2, SPC_CPULoad, 0},
+		{SPC_Status, 5, 1, SPC_CPULoad, 9, 'a', 'b'},
+	} {
+		var m LoadMessage
+		if err := m.Decode(bytes.NewReader(rawMessage(sp))); err == nil { t.Errorf("subpacket % x decoded", sp) }
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	in := Identity{hostname:"web1.example.com", machine_id:"0123456789abcdef", labels:[]Label{{"dc", "par1"}, {"role", ""}}}
+	var out Identity
+	roundTrip(t, &in, &out)
+	if !reflect.DeepEqual(out, in) { t.Errorf("got %v, want %v", out, in) }
+}
+
+func TestIdentityMalformed(t *testing.T) {
+	for _,sp := range [][]byte{
+		{SPC_Identity, 0},
+		{SPC_Identity, 3, 5, 'w', 'e'},
+		// labels announced but missing
+		{SPC_Identity, 5, 1, 'h', 0, 2, 1},
+		{SPC_Identity, 7, 1, 'h', 0, 1, 1, 'k', 3},
+	} {
+		var m LoadMessage
+		if err := m.Decode(bytes.NewReader(rawMessage(sp))); err == nil { t.Errorf("subpacket % x decoded", sp) }
+	}
+}
+
+func TestInventory(t *testing.T) {
+	var in LoadMessage
+	in.Present = map[uint8]bool{SPC_Inventory:true}
+	for i := 0; i < 20; i ++ {
+		in.Inventory.Items = append(in.Inventory.Items, InventoryItem{key:fmt.Sprintf("pkg.%d", i), value:strings.Repeat("v", 40)})
+	}
+
+	var w bytes.Buffer
+	var out LoadMessage
+	if err := in.Encode(&w); err != nil { t.Fatal(err) }
+	if err := out.Decode(&w); err != nil { t.Fatal(err) }
+	if !reflect.DeepEqual(out.Inventory.Items, in.Inventory.Items) { t.Errorf("items differ after a round trip") }
+}
+
+func TestInventoryMalformed(t *testing.T) {
+	for _,sp := range [][]byte{
+		{SPC_Inventory, 0},
+		{SPC_Inventory, 4, 2, 1, 'k', 0},
+		{SPC_Inventory, 4, 1, 1, 'k', 1},
+		{SPC_Inventory, 3, 1, 5, 'k'},
+	} {
+		var m LoadMessage
+		if err := m.Decode(bytes.NewReader(rawMessage(sp))); err == nil { t.Errorf("subpacket % x decoded", sp) }
+	}
+}
+
+func TestMessageChecksum(t *testing.T) {
+	in := LoadMessage{Timestamp:100, Interval:60, Interval_ms:60000, Boot_id:0x1234, Sequence:7,
+		Present:map[uint8]bool{SPC_Timing:true}, Timing:Timing{window_ms:60000}}
+	var w bytes.Buffer
+	in.Encode(&w)
+	body := w.Bytes()
+
+	var out LoadMessage
+	if err := out.Decode(bytes.NewReader(body)); err != nil || out.Sequence != 7 || out.Boot_id != 0x1234 || !out.Present[SPC_Timing] {
+		t.Fatalf("got %v %v", out, err)
+	}
+	for i := 1; i < len(body); i ++ {
+		damaged := append([]byte(nil), body...)
+		damaged[i] ^= 0x10
+		if err := out.Decode(bytes.NewReader(damaged)); err != ErrChecksum { t.Errorf("damaged at %d: got %v", i, err) }
+	}
+	for _,cut := range [][]byte{{}, body[:1], body[:4], body[:len(body) - 1]} {
+		if err := out.Decode(bytes.NewReader(cut)); err == nil { t.Errorf("message of %d bytes decoded", len(cut)) }
+	}
+	if err := out.Decode(bytes.NewReader(rawMessage([]byte{0xfe, 0}))); err == nil { t.Errorf("unknown subpacket decoded") }
+}
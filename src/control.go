@@ -0,0 +1,270 @@
+package main
+
+import (
+	"net"
+	"fmt"
+	"time"
+	"bytes"
+	"errors"
+	"strings"
+	"strconv"
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// control requests, always signed, sent by a server to a sender
+const (
+	ControlVersion = 1
+	// probe and reply at once
+	CTL_SNAPSHOT = 1
+	// change the interval and the probes for a while
+	CTL_BURST = 2
+	// liveness table of a server
+	CTL_PEERS = 3
+)
+
+// requests are accepted for a few seconds after they were made, and only
+// once
+const ControlTimeout = 5 * time.Second
+
+// text replies are cut into parts of whole lines fitting in a datagram
+const ControlPartSize = 1200
+
+// limits of a burst, a request cannot keep a sender busy for long
+const (
+	ControlMinInterval = 10 // ms
+	ControlMaxDuration = 600 // seconds
+)
+
+var ErrControlKey = errors.New("control requests need a key shared with the peer")
+
+type ControlRequest struct {
+	command uint8
+	timestamp uint32
+	interval_ms uint32
+	duration uint32 // seconds
+	probes string
+	nonce uint32
+
+	// where and how to reply
+	conn *net.UDPConn
+	addr *net.UDPAddr
+	peer *LoadPeer
+}
+
+// ParseControl takes snapshot, peers, or
+// burst:<interval ms>:<seconds>[:probe,...]
+func ParseControl(s string) (req *ControlRequest, err error) {
+	fields := strings.SplitN(s, ":", 4)
+	switch fields[0] {
+	case "snapshot":
+		if len(fields) > 1 { return nil, fmt.Errorf("snapshot takes no argument") }
+		return &ControlRequest{command:CTL_SNAPSHOT}, nil
+	case "peers":
+		if len(fields) > 1 { return nil, fmt.Errorf("peers takes no argument") }
+		return &ControlRequest{command:CTL_PEERS}, nil
+	case "burst":
+		if len(fields) < 3 { return nil, fmt.Errorf("burst needs an interval and a duration") }
+		req = &ControlRequest{command:CTL_BURST}
+		interval, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil { return nil, fmt.Errorf("invalid burst interval %s", fields[1]) }
+		duration, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil { return nil, fmt.Errorf("invalid burst duration %s", fields[2]) }
+		req.interval_ms, req.duration = uint32(interval), uint32(duration)
+		if len(fields) > 3 { req.probes = fields[3] }
+		if err = req.CheckBurst(); err != nil { return nil, err }
+		return req, nil
+	}
+	return nil, fmt.Errorf("unknown control request %s", fields[0])
+}
+
+func (req *ControlRequest) Encode() []byte {
+	w := new(bytes.Buffer)
+	binary.Write(w, binary.BigEndian, uint8(ControlVersion))
+	binary.Write(w, binary.BigEndian, req.command)
+	binary.Write(w, binary.BigEndian, req.timestamp)
+	binary.Write(w, binary.BigEndian, req.nonce)
+	binary.Write(w, binary.BigEndian, req.interval_ms)
+	binary.Write(w, binary.BigEndian, req.duration)
+	writeString(w, req.probes)
+	return w.Bytes()
+}
+
+func (req *ControlRequest) Decode(buf []byte) (err error) {
+	var version uint8
+	r := bytes.NewReader(buf)
+
+	if err = binary.Read(r, binary.BigEndian, &version); err != nil { return }
+	if version != ControlVersion { return fmt.Errorf("control version mismatch") }
+	if err = binary.Read(r, binary.BigEndian, &req.command); err != nil { return }
+	if err = binary.Read(r, binary.BigEndian, &req.timestamp); err != nil { return }
+	if err = binary.Read(r, binary.BigEndian, &req.nonce); err != nil { return }
+	if err = binary.Read(r, binary.BigEndian, &req.interval_ms); err != nil { return }
+	if err = binary.Read(r, binary.BigEndian, &req.duration); err != nil { return }
+	if req.probes, err = readString(r); err != nil { return }
+	if req.command == CTL_BURST { err = req.CheckBurst() }
+	return
+}
+
+// CheckBurst rejects the bursts beyond the limits, the sender takes them
+// from the network as well
+func (req *ControlRequest) CheckBurst() error {
+	if req.interval_ms < ControlMinInterval {
+		return fmt.Errorf("invalid burst interval %d, at least %dms", req.interval_ms, ControlMinInterval)
+	}
+	if req.duration == 0 || req.duration > ControlMaxDuration {
+		return fmt.Errorf("invalid burst duration %d, 1 to %d seconds", req.duration, ControlMaxDuration)
+	}
+	_,err := ParseSchedule(req.probes)
+	return err
+}
+
+// Schedule returns the probe schedule of a burst, the probes not requested
+// are disabled
+func (req *ControlRequest) Schedule(current map[uint8]int) map[uint8]int {
+	sched, _ := ParseSchedule(req.probes)
+	if req.probes == "" {
+		for spcode,multiple := range current { sched[spcode] = multiple }
+		return sched
+	}
+	for _,spcode := range ProbeCodes {
+		if _,ok := sched[spcode]; !ok { sched[spcode] = 0 }
+	}
+	return sched
+}
+
+// Reply sends a message to the server which made the request
+func (req *ControlRequest) Reply(msg []byte) error {
+	packet, err := req.peer.Envelope(msg)
+	if err != nil { return err }
+	_,err = req.conn.WriteToUDP(packet, req.addr)
+	return err
+}
+
+// ReplyText sends a text reply in parts, each one starts with its UINT16
+// number, from 1, and the UINT16 number of parts
+func (req *ControlRequest) ReplyText(text []byte) error {
+	var parts [][]byte
+	for len(text) > ControlPartSize {
+		n := bytes.LastIndexByte(text[:ControlPartSize], '\n') + 1
+		if n == 0 { n = ControlPartSize }
+		parts = append(parts, text[:n])
+		text = text[n:]
+	}
+	parts = append(parts, text)
+	if len(parts) > 0xffff { return fmt.Errorf("reply too long") }
+
+	for i,part := range parts {
+		msg := new(bytes.Buffer)
+		binary.Write(msg, binary.BigEndian, uint16(i + 1))
+		binary.Write(msg, binary.BigEndian, uint16(len(parts)))
+		msg.Write(part)
+		if err := req.Reply(msg.Bytes()); err != nil { return err }
+	}
+	return nil
+}
+
+// ListenControl passes the authorized requests received on listen to the
+// sender or the server, by command
+func ListenControl(listen string, keys KeyRing, seals SealRing, routes map[uint8]chan<- *ControlRequest) error {
+	laddr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil { return err }
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil { return err }
+
+	go func() {
+		seen := make(map[[2]uint32]bool)
+		buf := make([]byte, 2000)
+		for {
+			n,addr,err := conn.ReadFromUDP(buf)
+			if err != nil { continue }
+
+			ip := addr.IP.String()
+			peer := &LoadPeer{name:ip, key:keys.Key(ip), seal:seals.Keys(ip)}
+			if peer.key == nil {
+				fmt.Printf("Error control request from %s: %v\n", ip, ErrControlKey)
+				continue
+			}
+			msg,err := Verify(buf[:n], peer.key)
+			if err == nil { msg,err = Open(msg, peer.seal) }
+			req := &ControlRequest{conn:conn, addr:addr, peer:peer}
+			if err == nil { err = req.Decode(msg) }
+			if err != nil {
+				fmt.Printf("Error control request from %s: %v\n", ip, err)
+				continue
+			}
+
+			requests := routes[req.command]
+			if requests == nil {
+				fmt.Printf("Error control request from %s: unsupported command %d\n", ip, req.command)
+				continue
+			}
+
+			d := time.Since(FromTimestamp(req.timestamp))
+			id := [2]uint32{req.timestamp, req.nonce}
+			if d > ControlTimeout || d < -ControlTimeout || seen[id] {
+				fmt.Printf("Error control request from %s: expired or replayed\n", ip)
+				continue
+			}
+			for old := range seen {
+				if time.Since(FromTimestamp(old[0])) > ControlTimeout { delete(seen, old) }
+			}
+			seen[id] = true
+			requests <- req
+		}
+	}()
+	return nil
+}
+
+// SendControl makes a request to a sender and returns its reply
+func SendControl(hostport string, req *ControlRequest, keys KeyRing, seals SealRing) ([]byte, error) {
+	raddr, err := net.ResolveUDPAddr("udp", hostport)
+	if err != nil { return nil, err }
+	host, _, _ := net.SplitHostPort(hostport)
+	peer := &LoadPeer{name:host, key:keys.Key(host, raddr.IP.String()), seal:seals.Keys(host, raddr.IP.String())}
+	if peer.key == nil { return nil, ErrControlKey }
+
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil { return nil, err }
+	defer conn.Close()
+
+	req.timestamp = GetTimestamp()
+	var nonce [4]byte
+	if _,err = rand.Read(nonce[:]); err != nil { return nil, err }
+	req.nonce = binary.BigEndian.Uint32(nonce[:])
+	packet, err := peer.Envelope(req.Encode())
+	if err != nil { return nil, err }
+	if _,err = conn.Write(packet); err != nil { return nil, err }
+
+	// a burst replies with its first message, peers with the liveness table
+	timeout := ControlTimeout
+	if req.command == CTL_BURST { timeout += time.Duration(req.interval_ms) * time.Millisecond }
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 65536)
+	receive := func() ([]byte, error) {
+		n, err := conn.Read(buf)
+		if err != nil { return nil, err }
+		msg, err := Verify(buf[:n], peer.key)
+		if err == nil { msg, err = Open(msg, peer.seal) }
+		return msg, err
+	}
+	if req.command != CTL_PEERS { return receive() }
+
+	parts := make(map[uint16][]byte)
+	for count := 1; len(parts) < count; {
+		msg, err := receive()
+		if err != nil { return nil, err }
+		if len(msg) < 4 { return nil, fmt.Errorf("premature reply") }
+		i, n := binary.BigEndian.Uint16(msg), binary.BigEndian.Uint16(msg[2:])
+		if i == 0 || i > n { return nil, fmt.Errorf("invalid reply part %d/%d", i, n) }
+		parts[i] = append([]byte(nil), msg[4:]...)
+		count = int(n)
+	}
+	var text []byte
+	for i := 1; i <= len(parts); i ++ {
+		part, ok := parts[uint16(i)]
+		if !ok { return nil, fmt.Errorf("reply part %d missing", i) }
+		text = append(text, part...)
+	}
+	return text, nil
+}
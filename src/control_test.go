@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"fmt"
+	"time"
+	"bytes"
+	"testing"
+	"reflect"
+)
+
+func TestParseControl(t *testing.T) {
+	for s, want := range map[string]ControlRequest{
+		"snapshot": {command:CTL_SNAPSHOT},
+		"peers": {command:CTL_PEERS},
+		"burst:100:60": {command:CTL_BURST, interval_ms:100, duration:60},
+		"burst:10:600:cpu,net:2": {command:CTL_BURST, interval_ms:10, duration:600, probes:"cpu,net:2"},
+	} {
+		req, err := ParseControl(s)
+		if err != nil || !reflect.DeepEqual(*req, want) { t.Errorf("%q: got %v %v, want %v", s, req, err, want) }
+	}
+
+	for _,s := range []string{"", "reboot", "snapshot:1", "peers:all", "burst", "burst:100", "burst:x:60", "burst:100:-1",
+		"burst:9:60", "burst:100:0", "burst:100:601", "burst:100:60:disk"} {
+		if _,err := ParseControl(s); err == nil { t.Errorf("%q parsed", s) }
+	}
+}
+
+func TestControlCodec(t *testing.T) {
+	in := ControlRequest{command:CTL_BURST, timestamp:1234, nonce:0xdeadbeef, interval_ms:250, duration:30, probes:"cpu"}
+	var out ControlRequest
+	if err := out.Decode(in.Encode()); err != nil || !reflect.DeepEqual(out, in) { t.Errorf("got %v %v, want %v", out, err, in) }
+
+	buf := in.Encode()
+	for n := 0; n < len(buf); n ++ {
+		if err := out.Decode(buf[:n]); err == nil { t.Errorf("request cut at %d decoded", n) }
+	}
+	buf[0] = ControlVersion + 1
+	if err := out.Decode(buf); err == nil { t.Errorf("other version decoded") }
+
+	// the sender checks the bursts it is sent
+	for _,burst := range []ControlRequest{
+		{command:CTL_BURST, interval_ms:1, duration:30},
+		{command:CTL_BURST, interval_ms:100, duration:86400},
+		{command:CTL_BURST, interval_ms:100, duration:30, probes:"disk"},
+	} {
+		if err := out.Decode(burst.Encode()); err == nil { t.Errorf("burst %v decoded", burst) }
+	}
+}
+
+func TestControlSchedule(t *testing.T) {
+	current := map[uint8]int{SPC_NUMALoad:0, SPC_CPULoad:2}
+	if sched := (&ControlRequest{}).Schedule(current); !reflect.DeepEqual(sched, current) { t.Errorf("got %v", sched) }
+
+	sched := (&ControlRequest{probes:"cpu,net:3"}).Schedule(current)
+	for _,spcode := range ProbeCodes {
+		want := 0
+		if spcode == SPC_CPULoad { want = 1 }
+		if spcode == SPC_NetworkLoad { want = 3 }
+		if sched[spcode] != want { t.Errorf("probe %s: got %d, want %d", ProbeNames[spcode], sched[spcode], want) }
+	}
+}
+
+// freeAddr returns a local udp address not in use
+func freeAddr(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP:net.IPv4(127, 0, 0, 1)})
+	if err != nil { t.Fatal(err) }
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestListenControl(t *testing.T) {
+	addr := freeAddr(t)
+	keys := KeyRing{"127.0.0.1":[]byte("0123456789abcdef")}
+	snapshots := make(chan *ControlRequest, 4)
+	if err := ListenControl(addr, keys, nil, map[uint8]chan<- *ControlRequest{CTL_SNAPSHOT:snapshots}); err != nil { t.Fatal(err) }
+
+	go func() {
+		req := <-snapshots
+		req.Reply([]byte{4, 1})
+	}()
+	reply, err := SendControl(addr, &ControlRequest{command:CTL_SNAPSHOT}, keys, nil)
+	if err != nil || !reflect.DeepEqual(reply, []byte{4, 1}) { t.Fatalf("got % x %v", reply, err) }
+
+	// replayed, unsigned, expired and unrouted requests are dropped
+	conn, err := net.Dial("udp", addr)
+	if err != nil { t.Fatal(err) }
+	defer conn.Close()
+	peer := &LoadPeer{key:keys["127.0.0.1"]}
+	req := ControlRequest{command:CTL_SNAPSHOT, timestamp:GetTimestamp(), nonce:1}
+	packet,_ := peer.Envelope(req.Encode())
+	conn.Write(packet)
+	conn.Write(packet)
+	conn.Write(req.Encode())
+	expired := ControlRequest{command:CTL_SNAPSHOT, timestamp:GetTimestamp() - 60, nonce:2}
+	packet,_ = peer.Envelope(expired.Encode())
+	conn.Write(packet)
+	unrouted := ControlRequest{command:CTL_PEERS, timestamp:GetTimestamp(), nonce:3}
+	packet,_ = peer.Envelope(unrouted.Encode())
+	conn.Write(packet)
+
+	time.Sleep(200 * time.Millisecond)
+	if len(snapshots) != 1 { t.Errorf("%d requests passed", len(snapshots)) }
+}
+
+func TestReplyText(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP:net.IPv4(127, 0, 0, 1)})
+	if err != nil { t.Fatal(err) }
+	defer conn.Close()
+	keys := KeyRing{"127.0.0.1":[]byte("0123456789abcdef")}
+
+	var text []byte
+	for i := 0; i < 200; i ++ { text = append(text, fmt.Sprintf("peer 10.0.%d.%d: up, last message never, interval 1m0s\n", i / 10, i)...) }
+
+	// a server replies with its liveness table in parts
+	go func() {
+		buf := make([]byte, 2000)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil { return }
+		peer := &LoadPeer{name:"127.0.0.1", key:keys["127.0.0.1"]}
+		if _,err = Verify(buf[:n], peer.key); err != nil { return }
+		req := &ControlRequest{conn:conn, addr:addr, peer:peer}
+		req.ReplyText(text)
+	}()
+
+	reply, err := SendControl(conn.LocalAddr().String(), &ControlRequest{command:CTL_PEERS}, keys, nil)
+	if err != nil || !bytes.Equal(reply, text) { t.Errorf("got %d bytes %v, want %d", len(reply), err, len(text)) }
+}
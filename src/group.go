@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"fmt"
+	"sort"
+)
+
+// TagFilter matches messages whose host carries all of the labels
+type TagFilter []Label
+
+func (filter TagFilter) Match(m *LoadMessage) bool {
+	if len(filter) == 0 { return true }
+	if !m.Present[SPC_Identity] { return false }
+
+	for _,label := range filter {
+		value, ok := m.Identity.Label(label.key)
+		if !ok || value != label.value { return false }
+	}
+	return true
+}
+
+type mean struct {
+	sum float64
+	n int
+}
+
+func (v *mean) add(x float64) {
+	v.sum += x
+	v.n ++
+}
+
+func (v *mean) value() float64 {
+	if v.n == 0 { return 0 }
+	return v.sum / float64(v.n)
+}
+
+type GroupStats struct {
+	messages int
+	hosts map[string]bool
+	load1, cpu_busy, memfree, io_kbytes, net_kbytes mean
+}
+
+// Aggregator summarizes messages grouped by the value of a host label
+type Aggregator struct {
+	key string
+	groups map[string]*GroupStats
+}
+
+func NewAggregator(key string) *Aggregator {
+	return &Aggregator{key:key, groups:make(map[string]*GroupStats)}
+}
+
+func (a *Aggregator) Add(m *LoadMessage) {
+	group := "(none)"
+	host := "(unknown)"
+	if m.Present[SPC_Identity] {
+		if value, ok := m.Identity.Label(a.key); ok { group = value }
+		host = m.Identity.hostname
+	}
+
+	st := a.groups[group]
+	if st == nil {
+		st = &GroupStats{hosts:make(map[string]bool)}
+		a.groups[group] = st
+	}
+	st.messages ++
+	st.hosts[host] = true
+
+	if m.Present[SPC_ProcLoad] { st.load1.add(float64(m.Proc_load.Loadavg[0])) }
+	if m.Present[SPC_CPULoad] {
+		for _,item := range m.Cpu_load.Items {
+			st.cpu_busy.add(float64(255 - int(item.Rate_idle)) / 2.55)
+		}
+	}
+	if m.Present[SPC_MemoryLoad] { st.memfree.add(float64(m.Mem_load.free)) }
+	if m.Present[SPC_IOLoad] {
+		var kbytes float64
+		for _,rate := range m.Io_load.Rates() { kbytes += rate.kbytes_read + rate.kbytes_written }
+		st.io_kbytes.add(kbytes)
+	}
+	if m.Present[SPC_NetworkLoad] {
+		var kbytes float64
+		for _,rate := range m.Net_load.Rates() { kbytes += rate.kbytes_read + rate.kbytes_written }
+		st.net_kbytes.add(kbytes)
+	}
+}
+
+func (a *Aggregator) Dump(w io.Writer) {
+	names := make([]string, 0, len(a.groups))
+	for name := range a.groups { names = append(names, name) }
+	sort.Strings(names)
+
+	for _,name := range names {
+		st := a.groups[name]
+		fmt.Fprintf(w, "group %s=%s: hosts %d, messages %d, load1 %.2f, cpu busy %.1f%%, memfree %.0f, io kbytes/s %.1f, net kbytes/s %.1f\n",
+			a.key, name, len(st.hosts), st.messages, st.load1.value(), st.cpu_busy.value(),
+			st.memfree.value(), st.io_kbytes.value(), st.net_kbytes.value())
+	}
+}
+
+func (a *Aggregator) Reset() {
+	a.groups = make(map[string]*GroupStats)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func labelled(hostname string, labels ...Label) *LoadMessage {
+	return &LoadMessage{Present:map[uint8]bool{SPC_Identity:true, SPC_ProcLoad:true},
+		Identity:Identity{hostname:hostname, labels:labels}}
+}
+
+func TestTagFilter(t *testing.T) {
+	m := labelled("web1", Label{"dc", "par1"}, Label{"role", "web"})
+	for _,c := range []struct{ filter TagFilter; m *LoadMessage; want bool }{
+		{nil, &LoadMessage{}, true},
+		{TagFilter{{"dc", "par1"}}, m, true},
+		{TagFilter{{"dc", "par1"}, {"role", "web"}}, m, true},
+		{TagFilter{{"dc", "par1"}, {"role", "db"}}, m, false},
+		{TagFilter{{"rack", ""}}, m, false},
+		{TagFilter{{"dc", "par1"}}, &LoadMessage{}, false},
+	} {
+		if got := c.filter.Match(c.m); got != c.want { t.Errorf("%v: got %v, want %v", c.filter, got, c.want) }
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	a := NewAggregator("dc")
+	for _,m := range []*LoadMessage{
+		labelled("web1", Label{"dc", "par1"}),
+		labelled("web1", Label{"dc", "par1"}),
+		labelled("web2", Label{"dc", "par1"}),
+		labelled("db1", Label{"dc", "ams1"}),
+		labelled("db2"),
+	} { m.Proc_load.Loadavg[0] = 1; a.Add(m) }
+
+	var w bytes.Buffer
+	a.Dump(&w)
+	want := "group dc=(none): hosts 1, messages 1, load1 1.00, cpu busy 0.0%, memfree 0, io kbytes/s 0.0, net kbytes/s 0.0\n" +
+		"group dc=ams1: hosts 1, messages 1, load1 1.00, cpu busy 0.0%, memfree 0, io kbytes/s 0.0, net kbytes/s 0.0\n" +
+		"group dc=par1: hosts 2, messages 3, load1 1.00, cpu busy 0.0%, memfree 0, io kbytes/s 0.0, net kbytes/s 0.0\n"
+	if w.String() != want { t.Errorf("got\n%swant\n%s", w.String(), want) }
+
+	a.Reset()
+	w.Reset()
+	if a.Dump(&w); w.Len() != 0 { t.Errorf("groups left after a reset: %s", w.String()) }
+}
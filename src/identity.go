@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"io/ioutil"
+	"./sutils"
+)
+
+func ParseLabels(s string) (labels []Label, err error) {
+	if s == "" { return }
+
+	for _,ss := range strings.Split(s, ",") {
+		fields := strings.SplitN(ss, "=", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid label %s, should be key=value", ss)
+		}
+		labels = append(labels, Label{key:fields[0], value:fields[1]})
+	}
+	return
+}
+
+// ReadLabelFile reads key=value lines, empty lines and # comments are skipped
+func ReadLabelFile(filename string) (labels []Label, err error) {
+	file, err := os.Open(filename)
+	if err != nil { return }
+	defer file.Close()
+
+	var lines []string
+	err = sutils.ReadLines(file, func (line string) error {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") { lines = append(lines, line) }
+		return nil
+	})
+	if err != nil { return }
+
+	return ParseLabels(strings.Join(lines, ","))
+}
+
+func (id *Identity) Probe() (err error) {
+	id.hostname, err = os.Hostname()
+	if err != nil { return fmt.Errorf("Identity.Probe: failed get hostname") }
+
+	id.machine_id = ""
+	for _,filename := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		buf, err := ioutil.ReadFile(filename)
+		if err != nil { continue }
+		id.machine_id = strings.TrimSpace(string(buf))
+		break
+	}
+
+	return nil
+}
+
+func (id *Identity) Label(key string) (string, bool) {
+	for _,label := range id.labels {
+		if label.key == key { return label.value, true }
+	}
+	return "", false
+}
+
+// HostID names the host of a message by its machine id, or its hostname,
+// "" if the message carries no identity
+func HostID(m *LoadMessage) string {
+	if !m.Present[SPC_Identity] { return "" }
+	if m.Identity.machine_id != "" { return m.Identity.machine_id }
+	return m.Identity.hostname
+}
+
+// PeerKey names the sender of a message, by the peer name, which is its
+// source address for relayed messages, or, if the receiver is told so by
+// -k, by the identity the sender reports
+func PeerKey(name string, m *LoadMessage) (key string) {
+	if m.Present[SPC_Identity] {
+		switch *f_key {
+		case "hostname": key = m.Identity.hostname
+		case "machineid": key = m.Identity.machine_id
+		}
+	}
+	if key == "" { key = name }
+	// the key is used as log file name
+	return strings.Replace(key, "/", "_", -1)
+}
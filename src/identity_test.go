@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"reflect"
+	"path/filepath"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("dc=par1,role=,path=a=b")
+	want := []Label{{"dc", "par1"}, {"role", ""}, {"path", "a=b"}}
+	if err != nil || !reflect.DeepEqual(labels, want) { t.Errorf("got %v %v, want %v", labels, err, want) }
+
+	for _,s := range []string{"dc", "=par1", "dc=par1,", "dc=par1,,role=db"} {
+		if _,err := ParseLabels(s); err == nil { t.Errorf("%q parsed", s) }
+	}
+}
+
+func TestReadLabelFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "labels")
+	os.WriteFile(filename, []byte("# site\ndc=par1\n\n  role=db  \nrack=12"), 0644)
+
+	labels, err := ReadLabelFile(filename)
+	want := []Label{{"dc", "par1"}, {"role", "db"}, {"rack", "12"}}
+	if err != nil || !reflect.DeepEqual(labels, want) { t.Errorf("got %v %v, want %v", labels, err, want) }
+}
+
+func TestPeerKey(t *testing.T) {
+	m := &LoadMessage{Present:map[uint8]bool{SPC_Identity:true},
+		Identity:Identity{hostname:"web1", machine_id:"0123abcd"}}
+	defer func(key string) { *f_key = key }(*f_key)
+
+	for _,c := range []struct{ key, name string; m *LoadMessage; want string }{
+		{"ip", "10.0.0.1", m, "10.0.0.1"},
+		{"hostname", "10.0.0.1", m, "web1"},
+		{"machineid", "10.0.0.1", m, "0123abcd"},
+		{"hostname", "10.0.0.1", &LoadMessage{}, "10.0.0.1"},
+		{"ip", "fe80::1/64", m, "fe80::1_64"},
+	} {
+		*f_key = c.key
+		if got := PeerKey(c.name, c.m); got != c.want { t.Errorf("-k %q: got %s, want %s", c.key, got, c.want) }
+	}
+}
+
+func TestHostID(t *testing.T) {
+	for _,c := range []struct{ m *LoadMessage; want string }{
+		{&LoadMessage{}, ""},
+		{&LoadMessage{Identity:Identity{hostname:"web1"}}, ""},
+		{&LoadMessage{Present:map[uint8]bool{SPC_Identity:true}, Identity:Identity{hostname:"web1"}}, "web1"},
+		{&LoadMessage{Present:map[uint8]bool{SPC_Identity:true}, Identity:Identity{hostname:"web1", machine_id:"0123abcd"}}, "0123abcd"},
+	} {
+		if got := HostID(c.m); got != c.want { t.Errorf("%v: got %q, want %q", c.m.Identity, got, c.want) }
+	}
+}
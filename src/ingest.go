@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"bytes"
+	"strconv"
+	"strings"
+	"./sutils"
+)
+
+// distinct metric names kept between two flushes, the values of the other
+// names are dropped
+const MetricsMaxNames = 100
+
+type gauge struct {
+	last, min, max float64
+}
+
+// MetricsListener receives StatsD-like "name:value|c" and "name:value|g"
+// lines over a unix datagram socket and aggregates them per interval
+type MetricsListener struct {
+	conn *net.UnixConn
+	lock sync.Mutex
+	counters map[string]float64
+	gauges map[string]*gauge
+	dropped int // values of new names beyond MetricsMaxNames since the last flush
+}
+
+func ListenMetrics(path string) (l *MetricsListener, err error) {
+	os.Remove(path) // stale socket left by a previous run
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name:path, Net:"unixgram"})
+	if err != nil { return }
+
+	l = &MetricsListener{conn:conn}
+	l.reset()
+	go l.serve()
+	return
+}
+
+func (l *MetricsListener) reset() {
+	l.counters = make(map[string]float64)
+	l.gauges = make(map[string]*gauge)
+	l.dropped = 0
+}
+
+// full tells if a value of name would go beyond MetricsMaxNames
+func (l *MetricsListener) full(name string) bool {
+	if len(l.counters) + len(l.gauges) < MetricsMaxNames { return false }
+	_,counter := l.counters[name]
+	return !counter && l.gauges[name] == nil
+}
+
+func (l *MetricsListener) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, err := l.conn.Read(buf)
+		if err != nil { return }
+		sutils.ReadLines(bytes.NewReader(buf[:n]), func (line string) error {
+			l.add(strings.TrimSpace(line))
+			return nil
+		})
+	}
+}
+
+func (l *MetricsListener) add(line string) {
+	// name:value|type[|@rate]
+	i := strings.LastIndex(line, ":")
+	if i <= 0 { return }
+	name := line[:i]
+	if len(name) > MetricMaxName - 4 { name = name[:MetricMaxName - 4] }
+	fields := strings.Split(line[i+1:], "|")
+	if len(fields) < 2 { return }
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil { return }
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if (fields[1] == "c" || fields[1] == "g") && l.full(name) {
+		l.dropped ++
+		return
+	}
+
+	switch fields[1] {
+	case "c":
+		if len(fields) > 2 && strings.HasPrefix(fields[2], "@") {
+			rate, err := strconv.ParseFloat(fields[2][1:], 64)
+			if err == nil && rate > 0 { value /= rate }
+		}
+		l.counters[name] += value
+	case "g":
+		g := l.gauges[name]
+		if g == nil {
+			l.gauges[name] = &gauge{value, value, value}
+			return
+		}
+		g.last = value
+		if value < g.min { g.min = value }
+		if value > g.max { g.max = value }
+	}
+}
+
+// Flush returns the values aggregated since the previous call: the sum of
+// each counter, and the last/min/max of each gauge
+func (l *MetricsListener) Flush() (items []MetricItem) {
+	l.lock.Lock()
+	counters, gauges, dropped := l.counters, l.gauges, l.dropped
+	l.reset()
+	l.lock.Unlock()
+
+	if dropped > 0 { fmt.Printf("Warning: %d metrics dropped, more than %d names received\n", dropped, MetricsMaxNames) }
+
+	for name, value := range counters {
+		items = append(items, MetricItem{name:name, value:value})
+	}
+	for name, g := range gauges {
+		items = append(items, MetricItem{name:name, value:g.last})
+		items = append(items, MetricItem{name:name + ".min", value:g.min})
+		items = append(items, MetricItem{name:name + ".max", value:g.max})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].name < items[j].name })
+	return
+}
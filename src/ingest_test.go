@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+	"testing"
+	"reflect"
+	"path/filepath"
+)
+
+func TestMetricsListenerFlush(t *testing.T) {
+	l := &MetricsListener{}
+	l.reset()
+	for _,line := range []string{
+		"hits:1|c", "hits:2|c", "sampled:1|c|@0.5",
+		"temp:20|g", "temp:25|g", "temp:18|g", "temp:22|g",
+		"bad", ":1|c", "novalue:|c", "notype:1", "name:with:colons:3|c",
+	} { l.add(line) }
+
+	want := []MetricItem{
+		{name:"hits", value:3},
+		{name:"name:with:colons", value:3},
+		{name:"sampled", value:2},
+		{name:"temp", value:22},
+		{name:"temp.max", value:25},
+		{name:"temp.min", value:18},
+	}
+	if items := l.Flush(); !reflect.DeepEqual(items, want) { t.Errorf("got %v, want %v", items, want) }
+	if items := l.Flush(); len(items) != 0 { t.Errorf("got %v after a flush", items) }
+}
+
+func TestMetricsListenerSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+	l, err := ListenMetrics(path)
+	if err != nil { t.Fatal(err) }
+	defer l.conn.Close()
+
+	conn, err := net.Dial("unixgram", path)
+	if err != nil { t.Fatal(err) }
+	defer conn.Close()
+	conn.Write([]byte("a:1|c\nb:2|g"))
+
+	// the datagram is read asynchronously
+	var items []MetricItem
+	for i := 0; i < 100 && len(items) < 4; i ++ {
+		time.Sleep(10 * time.Millisecond)
+		items = append(items, l.Flush()...)
+	}
+	if len(items) != 4 || items[0].name != "a" || items[1].name != "b" { t.Errorf("got %v", items) }
+}
+
+func TestMetricsListenerMaxNames(t *testing.T) {
+	l := &MetricsListener{}
+	l.reset()
+	for i := 0; i < MetricsMaxNames + 50; i ++ { l.add(fmt.Sprintf("hits.%d:1|c", i)) }
+	// known names still take values
+	l.add("hits.0:1|c")
+	if l.dropped != 50 { t.Errorf("%d dropped, want 50", l.dropped) }
+
+	items := l.Flush()
+	if len(items) != MetricsMaxNames || items[0].name != "hits.0" || items[0].value != 2 { t.Errorf("got %d items, first %v", len(items), items[0]) }
+	if l.dropped != 0 { t.Errorf("%d dropped after a flush", l.dropped) }
+	l.add("new:1|g")
+	if items = l.Flush(); len(items) != 3 { t.Errorf("got %v after a flush", items) }
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"strings"
+	"syscall"
+	"io/ioutil"
+	"path/filepath"
+	"./sutils"
+)
+
+// keep an item within a subpacket
+const (
+	InventoryMaxKey = 50
+	InventoryMaxValue = 200
+)
+
+// items of an inventory part, a message carrying it with the header, the
+// identity and the envelopes still fits in a datagram
+const InventoryPartSize = 900
+
+// item numbering the parts of an inventory, "i/n"
+const InventoryPartKey = "inventory.part"
+
+func (inv *Inventory) add(key, value string) {
+	value = strings.TrimSpace(value)
+	if value == "" { return }
+	if len(key) > InventoryMaxKey { key = key[:InventoryMaxKey] }
+	if len(value) > InventoryMaxValue { value = value[:InventoryMaxValue] }
+	inv.Items = append(inv.Items, InventoryItem{key:key, value:value})
+}
+
+func (inv *Inventory) Probe() (err error) {
+	inv.Items = nil
+
+	var uts syscall.Utsname
+	if err = syscall.Uname(&uts); err != nil { return fmt.Errorf("Inventory.Probe: uname failed") }
+	// the utsname fields are int8 or uint8 depending on the architecture
+	var sysname, release, version, machine []byte
+	for i := 0; i < len(uts.Sysname) && uts.Sysname[i] != 0; i ++ { sysname = append(sysname, byte(uts.Sysname[i])) }
+	for i := 0; i < len(uts.Release) && uts.Release[i] != 0; i ++ { release = append(release, byte(uts.Release[i])) }
+	for i := 0; i < len(uts.Version) && uts.Version[i] != 0; i ++ { version = append(version, byte(uts.Version[i])) }
+	for i := 0; i < len(uts.Machine) && uts.Machine[i] != 0; i ++ { machine = append(machine, byte(uts.Machine[i])) }
+	inv.add("uname.sysname", string(sysname))
+	inv.add("uname.release", string(release))
+	inv.add("uname.version", string(version))
+	inv.add("uname.machine", string(machine))
+
+	buf, err := ioutil.ReadFile("/proc/version")
+	if err != nil { return fmt.Errorf("Inventory.Probe: failed open /proc/version") }
+	inv.add("kernel", string(buf))
+
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil { return fmt.Errorf("Inventory.Probe: failed open /proc/cpuinfo") }
+	var model string
+	var ncpu int
+	sutils.ReadLines(file, func (line string) (err error) {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 { return }
+		switch strings.TrimSpace(fields[0]) {
+		case "processor": ncpu ++
+		case "model name": if model == "" { model = fields[1] }
+		}
+		return
+	})
+	file.Close()
+	inv.add("cpu.model", model)
+	inv.add("cpu.count", fmt.Sprint(ncpu))
+
+	file, err = os.Open("/proc/meminfo")
+	if err != nil { return fmt.Errorf("Inventory.Probe: failed open /proc/meminfo") }
+	sutils.ReadLines(file, func (line string) (err error) {
+		if strings.HasPrefix(line, "MemTotal:") { inv.add("mem.total", strings.TrimPrefix(line, "MemTotal:")) }
+		return
+	})
+	file.Close()
+
+	// devices without a model or a link speed are skipped
+	models, _ := filepath.Glob("/sys/block/*/device/model")
+	for _,filename := range models {
+		buf, err := ioutil.ReadFile(filename)
+		if err != nil { continue }
+		dev := filepath.Base(filepath.Dir(filepath.Dir(filename)))
+		inv.add("disk." + dev + ".model", string(buf))
+	}
+
+	speeds, _ := filepath.Glob("/sys/class/net/*/speed")
+	for _,filename := range speeds {
+		buf, err := ioutil.ReadFile(filename)
+		if err != nil || strings.HasPrefix(string(buf), "-") { continue }
+		dev := filepath.Base(filepath.Dir(filename))
+		inv.add("nic." + dev + ".speed", strings.TrimSpace(string(buf)) + " Mb/s")
+	}
+
+	return nil
+}
+
+// Parts cuts the inventory into parts sent in messages of their own, each
+// one starts with an InventoryPartKey item
+func (inv *Inventory) Parts() (parts []Inventory) {
+	var part Inventory
+	size := 0
+
+	for _,item := range inv.Items {
+		itemsize := 2 + len(item.key) + len(item.value)
+		if size + itemsize > InventoryPartSize && len(part.Items) > 0 {
+			parts = append(parts, part)
+			part = Inventory{}
+			size = 0
+		}
+		part.Items = append(part.Items, item)
+		size += itemsize
+	}
+	if len(part.Items) > 0 || len(parts) == 0 { parts = append(parts, part) }
+
+	for i := range parts {
+		item := InventoryItem{key:InventoryPartKey, value:fmt.Sprintf("%d/%d", i + 1, len(parts))}
+		parts[i].Items = append([]InventoryItem{item}, parts[i].Items...)
+	}
+	return
+}
+
+// Part returns the number of a received inventory part and the number of
+// parts, 1/1 for inventories sent in one piece
+func (inv *Inventory) Part() (i, n int) {
+	for _,item := range inv.Items {
+		if item.key != InventoryPartKey { continue }
+		if _,err := fmt.Sscanf(item.value, "%d/%d", &i, &n); err == nil && i >= 1 && i <= n { return }
+	}
+	return 1, 1
+}
+
+// InventoryParts gathers the parts of the inventories received, by sender
+type InventoryParts map[string]*inventoryRound
+
+// the parts of one inventory have consecutive sequence numbers
+type inventoryRound struct {
+	boot_id uint64
+	first uint32 // sequence number of part 1
+	parts [][]byte
+	received int
+}
+
+// Add keeps the message msg carrying part i/n of the inventory of key, and
+// returns the messages of all parts in order once they all arrived. The
+// parts of an older inventory are dropped.
+func (inv InventoryParts) Add(key string, m *LoadMessage, msg []byte) [][]byte {
+	i, n := m.Inventory.Part()
+	first := m.Sequence - uint32(i - 1)
+	r := inv[key]
+	if r != nil && r.boot_id == m.Boot_id && int32(first - r.first) < 0 { return nil }
+	if r == nil || r.boot_id != m.Boot_id || r.first != first || len(r.parts) != n {
+		r = &inventoryRound{boot_id:m.Boot_id, first:first, parts:make([][]byte, n)}
+		inv[key] = r
+	}
+
+	if r.parts[i - 1] == nil { r.received ++ }
+	r.parts[i - 1] = msg
+	if r.received < n { return nil }
+	delete(inv, key)
+	return r.parts
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestInventoryAdd(t *testing.T) {
+	var inv Inventory
+	inv.add("empty", "  \n")
+	inv.add(strings.Repeat("k", 100), strings.Repeat("v", 300) + "\n")
+	if len(inv.Items) != 1 { t.Fatalf("got %v", inv.Items) }
+	if len(inv.Items[0].key) != InventoryMaxKey || len(inv.Items[0].value) != InventoryMaxValue { t.Errorf("item not truncated") }
+}
+
+func TestInventoryParts(t *testing.T) {
+	var inv Inventory
+	for i := 0; i < 40; i ++ { inv.add(strings.Repeat("k", 20), strings.Repeat("v", InventoryMaxValue)) }
+
+	parts := inv.Parts()
+	if len(parts) < 2 { t.Fatalf("%d parts", len(parts)) }
+	items := 0
+	for i := range parts {
+		if pi, n := parts[i].Part(); pi != i + 1 || n != len(parts) { t.Errorf("part %d: %d/%d", i + 1, pi, n) }
+		items += len(parts[i].Items) - 1
+
+		// a part fits in a relayed datagram along with the identity
+		m := LoadMessage{Present:map[uint8]bool{SPC_Identity:true, SPC_Inventory:true}, Inventory:parts[i],
+			Identity:Identity{hostname:strings.Repeat("h", 64), machine_id:strings.Repeat("0", 32)}}
+		var w bytes.Buffer
+		m.Encode(&w)
+		if w.Len() > RelayMaxSize - 100 { t.Errorf("part %d: message of %d bytes", i + 1, w.Len()) }
+	}
+	if items != 40 { t.Errorf("%d items in the parts, want 40", items) }
+
+	// an empty inventory is still sent, in one part
+	parts = (&Inventory{}).Parts()
+	if len(parts) != 1 || len(parts[0].Items) != 1 { t.Errorf("got %v", parts) }
+}
+
+func TestInventoryPart(t *testing.T) {
+	for _,c := range []struct{ value string; i, n int }{
+		{"2/3", 2, 3},
+		{"0/3", 1, 1},
+		{"4/3", 1, 1},
+		{"x", 1, 1},
+	} {
+		inv := Inventory{Items:[]InventoryItem{{key:InventoryPartKey, value:c.value}}}
+		if i, n := inv.Part(); i != c.i || n != c.n { t.Errorf("%q: got %d/%d, want %d/%d", c.value, i, n, c.i, c.n) }
+	}
+	if i, n := (&Inventory{}).Part(); i != 1 || n != 1 { t.Errorf("got %d/%d without a part item", i, n) }
+}
+
+func TestInventoryPartsAdd(t *testing.T) {
+	var inv Inventory
+	for i := 0; i < 40; i ++ { inv.add(strings.Repeat("k", 20), strings.Repeat("v", InventoryMaxValue)) }
+	parts := inv.Parts()
+	n := len(parts)
+	message := func(first uint32, i int) *LoadMessage {
+		return &LoadMessage{Boot_id:1, Sequence:first + uint32(i), Inventory:parts[i]}
+	}
+
+	// the parts arrive out of order
+	received := make(InventoryParts)
+	for i := n - 1; i > 0; i -- {
+		if got := received.Add("web1", message(10, i), []byte{byte(i)}); got != nil { t.Fatalf("saved before part 1") }
+	}
+	got := received.Add("web1", message(10, 0), []byte{0})
+	if len(got) != n || got[0][0] != 0 || got[n - 1][0] != byte(n - 1) { t.Errorf("got %v", got) }
+	if len(received) != 0 { t.Errorf("parts kept after saving") }
+
+	// a newer inventory replaces an incomplete one, the late parts of the
+	// older are dropped
+	received.Add("web1", message(20, 0), []byte{0})
+	received.Add("web1", message(30, 0), []byte{0})
+	for i := 1; i < n; i ++ {
+		if got = received.Add("web1", message(20, i), []byte{byte(i)}); got != nil { t.Errorf("older inventory saved") }
+	}
+	for i := 1; i < n; i ++ { got = received.Add("web1", message(30, i), []byte{byte(i)}) }
+	if len(got) != n { t.Errorf("newer inventory not saved") }
+
+	// inventories sent in one piece are saved at once
+	whole := &LoadMessage{Boot_id:1, Sequence:5, Inventory:Inventory{Items:[]InventoryItem{{key:"kernel", value:"6.1"}}}}
+	if got = received.Add("web2", whole, []byte{9}); len(got) != 1 { t.Errorf("got %v", got) }
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	LIVE_UP = iota
+	LIVE_LATE
+	LIVE_DOWN
+)
+
+var LivenessNames = []string{"up", "late", "down"}
+
+// Liveness is the state of a peer, from the time of its last message and
+// the interval it advertised
+type Liveness struct {
+	seen time.Time
+	interval time.Duration
+	state int
+	expected bool // nothing received yet, seen is when it was expected from
+}
+
+// LivenessTable tracks the peers by key, see PeerKey
+type LivenessTable map[string]*Liveness
+
+func (table LivenessTable) Seen(key string, interval time.Duration) {
+	live := table[key]
+	if live == nil {
+		live = &Liveness{}
+		table[key] = live
+	} else if live.state != LIVE_UP {
+		log.Printf("peer %s: up again after %v", key, time.Since(live.seen).Round(time.Second))
+	}
+	live.seen = time.Now()
+	live.interval = interval
+	live.state = LIVE_UP
+	live.expected = false
+}
+
+// Expect adds a configured peer before its first message, it goes down
+// like the others if it never sends anything
+func (table LivenessTable) Expect(key string, interval time.Duration) {
+	if table[key] != nil { return }
+	table[key] = &Liveness{seen:time.Now(), interval:interval, expected:true}
+}
+
+// Check marks the peers late, or down, when nothing was received from
+// them for late, or down, times their interval
+func (table LivenessTable) Check(late, down float64) {
+	for key,live := range table {
+		silent := time.Since(live.seen)
+		state := LIVE_UP
+		if silent > time.Duration(down * float64(live.interval)) {
+			state = LIVE_DOWN
+		} else if silent > time.Duration(late * float64(live.interval)) {
+			state = LIVE_LATE
+		}
+		if state > live.state && live.expected {
+			log.Printf("peer %s: %s, no message for %v", key, LivenessNames[state], silent.Round(time.Second))
+		} else if state > live.state {
+			log.Printf("peer %s: %s, last message %v ago", key, LivenessNames[state], silent.Round(time.Second))
+		}
+		if state > live.state { live.state = state }
+	}
+}
+
+func (table LivenessTable) Dump(w io.Writer) {
+	keys := make([]string, 0, len(table))
+	for key := range table { keys = append(keys, key) }
+	sort.Strings(keys)
+
+	for _,key := range keys {
+		live := table[key]
+		seen := live.seen.Format("20060102-150405")
+		if live.expected { seen = "never" }
+		fmt.Fprintf(w, "peer %s: %s, last message %s, interval %v\n", key, LivenessNames[live.state], seen, live.interval)
+	}
+}
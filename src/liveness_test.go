@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiveness(t *testing.T) {
+	table := make(LivenessTable)
+	table.Seen("web1", time.Minute)
+	table.Seen("web2", time.Minute)
+	table.Seen("web3", time.Minute)
+	table.Expect("web1", time.Hour)
+	table.Expect("db1", time.Minute)
+	if table["web1"].interval != time.Minute || table["web1"].expected { t.Errorf("seen peer expected again") }
+
+	table["web2"].seen = time.Now().Add(-3 * time.Minute)
+	table["web3"].seen = time.Now().Add(-10 * time.Minute)
+	table["db1"].seen = time.Now().Add(-10 * time.Minute)
+	table.Check(2, 5)
+	for key, want := range map[string]int{"web1":LIVE_UP, "web2":LIVE_LATE, "web3":LIVE_DOWN, "db1":LIVE_DOWN} {
+		if table[key].state != want { t.Errorf("%s: %s, want %s", key, LivenessNames[table[key].state], LivenessNames[want]) }
+	}
+
+	// states only get worse until a message is received
+	table["web3"].seen = time.Now()
+	table.Check(2, 5)
+	if table["web3"].state != LIVE_DOWN { t.Errorf("web3 up without a message") }
+	table.Seen("web3", time.Minute)
+	table.Seen("db1", time.Minute)
+	if table["web3"].state != LIVE_UP || table["db1"].state != LIVE_UP || table["db1"].expected { t.Errorf("peers not up again") }
+}
+
+func TestLivenessDump(t *testing.T) {
+	table := make(LivenessTable)
+	table.Expect("db1", time.Minute)
+	table.Seen("web1", time.Second)
+	table["web1"].state = LIVE_LATE
+
+	var w bytes.Buffer
+	table.Dump(&w)
+	lines := strings.Split(w.String(), "\n")
+	if len(lines) != 3 || lines[0] != "peer db1: up, last message never, interval 1m0s" ||
+		!strings.HasPrefix(lines[1], "peer web1: late, last message " + time.Now().Format("20060102")) {
+		t.Errorf("got %q", w.String())
+	}
+}
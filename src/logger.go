@@ -4,11 +4,20 @@ import (
 	"io"
 	"os"
 	"fmt"
+	"sync"
 	"time"
 	"bufio"
+	"bytes"
+	"hash/crc32"
 	"encoding/binary"
 )
 
+// flag in the length of records followed by their checksum
+const RecordChecksum = 0x8000
+
+// timestamp, length, message and checksum
+const RecordMaxSize = 6 + RecordChecksum - 1 + 4
+
 const (
 	MODE_READ = iota
 	MODE_APPEND
@@ -16,6 +25,7 @@ const (
 )
 
 type LogFile struct {
+	lock sync.Mutex // writers may share a log file
 	mode int
 	file *os.File
 	filename, basename string
@@ -56,6 +66,8 @@ func (logfile *LogFile) Open() (err error) {
 }
 
 func (logfile *LogFile) Close() {
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
 	if logfile.file != nil {
 		logfile.file.Close()
 		logfile.file = nil
@@ -66,6 +78,8 @@ func (logfile *LogFile) WriteMessage(buf []byte) error {
 	if logfile.mode != MODE_APPEND && logfile.mode != MODE_REWRITE {
 		return fmt.Errorf("invalid mode")
 	}
+	logfile.lock.Lock()
+	defer logfile.lock.Unlock()
 
 	now := time.Now()
 	ts := ToTimestamp(now)
@@ -82,26 +96,96 @@ func (logfile *LogFile) WriteMessage(buf []byte) error {
 	}
 
 	//logfile.file.Seek(0, os.SEEK_END)
-	w := bufio.NewWriter(logfile.file)
-	binary.Write(w, binary.BigEndian, ts)
-	binary.Write(w, binary.BigEndian, uint16(len(buf)))
-	w.Write(buf)
-	return w.Flush()
+	return WriteRecord(logfile.file, ts, buf)
+}
+
+// WriteRecord writes a log record in one write, it also frames messages
+// over stream connections
+func WriteRecord(w io.Writer, ts uint32, buf []byte) error {
+	if len(buf) >= RecordChecksum { return fmt.Errorf("message too long") }
+
+	record := new(bytes.Buffer)
+	binary.Write(record, binary.BigEndian, ts)
+	binary.Write(record, binary.BigEndian, uint16(len(buf)) | RecordChecksum)
+	record.Write(buf)
+	binary.Write(record, binary.BigEndian, crc32.Checksum(record.Bytes(), CRCTable))
+	_,err := w.Write(record.Bytes())
+	return err
 }
 
+// ReadMessage returns a *CorruptRecordError when the record at the current
+// position is damaged, the file is then positioned at the next good record
 func (logfile *LogFile) ReadMessage() (ts uint32, buf []byte, err error) {
 	if logfile.mode != MODE_READ {
 		err = fmt.Errorf("invalid mode")
 		return
 	}
 
+	start,err := logfile.file.Seek(0, io.SeekCurrent)
+	if err != nil { return }
+	ts,buf,err = ReadRecord(logfile.file)
+	if err == ErrChecksum || err == io.ErrUnexpectedEOF {
+		var next int64
+		next,err = logfile.resync(start + 1)
+		if err == nil { err = &CorruptRecordError{Offset:start, Skipped:next - start} }
+	}
+
+	return
+}
+
+func ReadRecord(r io.Reader) (ts uint32, buf []byte, err error) {
 	var msglen uint16
-	err = binary.Read(logfile.file, binary.BigEndian, &ts)
+	err = binary.Read(r, binary.BigEndian, &ts)
 	if err != nil { return }
-	err = binary.Read(logfile.file, binary.BigEndian, &msglen)
+	err = binary.Read(r, binary.BigEndian, &msglen)
+	if err == io.EOF { err = io.ErrUnexpectedEOF }
 	if err != nil { return }
-	buf = make([]byte, msglen)
-	_,err = io.ReadFull(logfile.file, buf)
+
+	// records written before the checksum was added have no flag
+	buf = make([]byte, msglen &^ RecordChecksum)
+	_,err = io.ReadFull(r, buf)
+	if err == io.EOF { err = io.ErrUnexpectedEOF }
+	if err != nil || msglen & RecordChecksum == 0 { return }
+
+	var crc uint32
+	err = binary.Read(r, binary.BigEndian, &crc)
+	if err == io.EOF { err = io.ErrUnexpectedEOF }
+	if err != nil { return }
+	h := crc32.New(CRCTable)
+	binary.Write(h, binary.BigEndian, ts)
+	binary.Write(h, binary.BigEndian, msglen)
+	h.Write(buf)
+	if h.Sum32() != crc { err = ErrChecksum }
 
 	return
 }
+
+// resync seeks to the first record from offset whose checksum is valid,
+// or to the end of the file, and returns the new position. It scans a
+// window of the largest record size.
+func (logfile *LogFile) resync(offset int64) (int64, error) {
+	_,err := logfile.file.Seek(offset, io.SeekStart)
+	if err != nil { return 0, err }
+	r := bufio.NewReaderSize(logfile.file, RecordMaxSize)
+
+	for i := int64(0); ; i ++ {
+		head,_ := r.Peek(10)
+		if len(head) < 10 { return logfile.file.Seek(0, io.SeekEnd) }
+		if msglen := binary.BigEndian.Uint16(head[4:]); msglen & RecordChecksum != 0 {
+			end := 6 + int(msglen &^ RecordChecksum)
+			record,_ := r.Peek(end + 4)
+			if len(record) == end + 4 && crc32.Checksum(record[:end], CRCTable) == binary.BigEndian.Uint32(record[end:]) {
+				return logfile.file.Seek(offset + i, io.SeekStart)
+			}
+		}
+		r.Discard(1)
+	}
+}
+
+type CorruptRecordError struct {
+	Offset, Skipped int64
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupted record at offset %d, skipped %d bytes", e.Offset, e.Skipped)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"os"
+	"bytes"
+	"testing"
+	"path/filepath"
+	"encoding/binary"
+)
+
+func TestRecord(t *testing.T) {
+	var w bytes.Buffer
+	if err := WriteRecord(&w, 1234, []byte("message")); err != nil { t.Fatal(err) }
+	if err := WriteRecord(&w, 1, make([]byte, RecordChecksum)); err == nil { t.Errorf("oversized record written") }
+	record := append([]byte(nil), w.Bytes()...)
+
+	ts, buf, err := ReadRecord(&w)
+	if err != nil || ts != 1234 || string(buf) != "message" { t.Errorf("got %d %q %v", ts, buf, err) }
+	if _,_,err = ReadRecord(&w); err != io.EOF { t.Errorf("got %v at the end", err) }
+
+	// records written before the checksum
+	legacy := []byte{0, 0, 0, 7, 0, 2, 'h', 'i'}
+	ts, buf, err = ReadRecord(bytes.NewReader(legacy))
+	if err != nil || ts != 7 || string(buf) != "hi" { t.Errorf("legacy record: got %d %q %v", ts, buf, err) }
+
+	for i := range record {
+		damaged := append([]byte(nil), record...)
+		damaged[i] ^= 0x01
+		if _,_,err = ReadRecord(bytes.NewReader(damaged)); err == nil { t.Errorf("record damaged at %d read", i) }
+	}
+	for n := 1; n < len(record); n ++ {
+		if _,_,err = ReadRecord(bytes.NewReader(record[:n])); err != io.ErrUnexpectedEOF { t.Errorf("record cut at %d: got %v", n, err) }
+	}
+}
+
+func TestLogFileResync(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "peer.log")
+	var w bytes.Buffer
+	WriteRecord(&w, 1, []byte("first"))
+	WriteRecord(&w, 2, []byte("second"))
+	WriteRecord(&w, 3, []byte("third"))
+	buf := w.Bytes()
+	buf[len(buf) / 2] ^= 0xff // in the second record
+	buf = append(buf, 0, 0, 0, 4, 0x80) // cut while writing
+	os.WriteFile(filename, buf, 0644)
+
+	logfile, err := OpenLogFile(filename, MODE_READ)
+	if err != nil { t.Fatal(err) }
+	defer logfile.Close()
+
+	var got []string
+	var corrupt []*CorruptRecordError
+	for {
+		_,msg,err := logfile.ReadMessage()
+		if err == io.EOF { break }
+		if cerr,ok := err.(*CorruptRecordError); ok {
+			corrupt = append(corrupt, cerr)
+			continue
+		}
+		if err != nil { t.Fatal(err) }
+		got = append(got, string(msg))
+	}
+
+	if len(got) != 2 || got[0] != "first" || got[1] != "third" { t.Errorf("got %q", got) }
+	if len(corrupt) != 2 || corrupt[0].Offset != 15 || corrupt[0].Skipped != 16 || corrupt[1].Skipped != 5 { t.Errorf("got %v", corrupt) }
+}
+
+func TestLogFileWrite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "peer.log")
+	logfile, err := OpenLogFile(filename, MODE_APPEND)
+	if err != nil { t.Fatal(err) }
+	logfile.WriteMessage([]byte("one"))
+	logfile.WriteMessage([]byte("two"))
+	logfile.Close()
+
+	buf, _ := os.ReadFile(filename)
+	if len(buf) != 2 * (10 + 3) || binary.BigEndian.Uint16(buf[4:]) != 3 | RecordChecksum { t.Errorf("got % x", buf) }
+	if err := logfile.Open(); err != nil { t.Fatal(err) }
+	defer logfile.Close()
+	if _,_,err = logfile.ReadMessage(); err == nil { t.Errorf("read from an append log file") }
+}
+
+func TestLogFileResyncLarge(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "peer.log")
+	var w bytes.Buffer
+	WriteRecord(&w, 1, []byte("first"))
+	garbage := make([]byte, 5 * RecordMaxSize)
+	for i := range garbage { garbage[i] = 0x80 } // checksummed records of 128 bytes
+	w.Write(garbage)
+	WriteRecord(&w, 2, make([]byte, RecordChecksum - 1))
+	WriteRecord(&w, 3, []byte("last"))
+	os.WriteFile(filename, w.Bytes(), 0644)
+
+	logfile, err := OpenLogFile(filename, MODE_READ)
+	if err != nil { t.Fatal(err) }
+	defer logfile.Close()
+
+	var sizes []int
+	for {
+		_,msg,err := logfile.ReadMessage()
+		if err == io.EOF { break }
+		if cerr,ok := err.(*CorruptRecordError); ok {
+			if cerr.Offset != 15 || cerr.Skipped != int64(len(garbage)) { t.Errorf("got %v", cerr) }
+			continue
+		}
+		if err != nil { t.Fatal(err) }
+		sizes = append(sizes, len(msg))
+	}
+	if len(sizes) != 3 || sizes[1] != RecordChecksum - 1 || sizes[2] != 4 { t.Errorf("got records of %v bytes", sizes) }
+}
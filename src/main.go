@@ -9,26 +9,83 @@ import (
 	"flag"
 	"time"
 	"bytes"
+	"sync"
+	"errors"
+	"sort"
 	"strings"
+	"strconv"
+	"hash/fnv"
+	"sync/atomic"
+	"crypto/rand"
 	"encoding/hex"
+	"encoding/binary"
 )
 
+// packets queued for each peer worker of the receiver
+const WorkerQueueSize = 64
+
+// workers delivering the relayed messages, by sender
+const RelayWorkers = 8
+
+// time between two checks of the liveness of the peers
+const LivenessCheckInterval = time.Second
+
 type LoadPeer struct {
+	name string // host as given in -P
+	proto string // udp, tcp or tls
+	hostport string
+	lock sync.Mutex // addr and conn change when the peer is resolved again
 	addr *net.UDPAddr
-	conn *net.UDPConn
+	conn *net.UDPConn // udp peers
+	queue chan []byte // tcp and tls peers, see Stream
+	spool *Spool // may be nil
 	logfile *LogFile
+	key []byte // signs messages to and from the peer if not nil
+	seal *SealKeys // encrypts messages to and from the peer if not nil
+	auto bool // registered on its first message, see Acceptor
+	relay bool // downstream relay, the only peers relayed messages are taken from
+	seen time.Time // last message of an auto peer
+	keys map[string]bool // of the senders received from the peer, see PeerKey
+	dropped uint64 // packets of the peer dropped by the receiver, its queue being full
+}
+
+// RelayedPacket is a message taken out of a relay envelope by the worker of
+// the relay, and delivered by a relay worker
+type RelayedPacket struct {
+	Packet
+	relay *LoadPeer
 }
 
-func Sender(interval int, logfile *LogFile, peers []LoadPeer) {
-	lm := LoadMessage{Interval:uint16(interval)}
+// Sender probes and sends a message every interval, and on the requests of
+// the servers
+func Sender(interval time.Duration, logfile *LogFile, peers []LoadPeer, requests <-chan *ControlRequest) {
+	sched, err := ParseSchedule(*f_schedule)
+	if err != nil { log.Fatal("invalid probe schedule:", err) }
+	lm := LoadMessage{Interval:uint16(interval / time.Second),
+		Interval_ms:uint32(interval / time.Millisecond), Schedule:sched}
+	if err = binary.Read(rand.Reader, binary.BigEndian, &lm.Boot_id); err != nil { log.Fatal("failed generate boot id:", err) }
 	lm.ProbeInit()
+	if *f_label_file != "" {
+		lm.Identity.labels, err = ReadLabelFile(*f_label_file)
+		if err != nil { log.Fatal("invalid label file:", err) }
+	}
+	labels, err := ParseLabels(*f_labels)
+	if err != nil { log.Fatal("invalid labels:", err) }
+	lm.Identity.labels = append(lm.Identity.labels, labels...)
+	if err = lm.Identity.Probe(); err != nil { log.Fatal(err) }
+	if _,buf := lm.Identity.Encode(); buf.Len() > 255 { log.Fatal("hostname, machine-id and labels too long") }
+	if *f_plugins != "" { lm.Custom_load.Plugins = strings.Split(*f_plugins, ",") }
+	lm.Custom_load.Timeout = time.Duration(*f_plugin_timeout) * time.Second
+	if *f_metrics_socket != "" {
+		listener, err := ListenMetrics(*f_metrics_socket)
+		if err != nil { log.Fatal("failed listen metrics socket:", err) }
+		lm.Custom_load.Listener = listener
+	}
 
-	for {
+	// send logs a message and sends it to the peers
+	send := func(m *LoadMessage) []byte {
 		var buffer bytes.Buffer
-		time.Sleep(time.Duration(lm.Interval) * time.Second)
-
-		lm.Probe()
-		if err := lm.Encode(&buffer); err != nil {
+		if err := m.Encode(&buffer); err != nil {
 			log.Fatal("encode error:", err)
 		}
 
@@ -38,42 +95,529 @@ func Sender(interval int, logfile *LogFile, peers []LoadPeer) {
 			hex.Dumper(os.Stdout).Write(buffer.Bytes())
 			fmt.Println()
 		}
-		lm.Dump(os.Stdout)
+		m.Dump(os.Stdout)
 		if logfile != nil { logfile.WriteMessage(buffer.Bytes()) }
 
-		for _,peer := range peers {
-			peer.conn.Write(buffer.Bytes())
+		for i := range peers {
+			peer := &peers[i]
+			packet,err := peer.Envelope(buffer.Bytes())
+			if err != nil { log.Fatal("encrypt error:", err) }
+			peer.Send(packet)
+		}
+		return buffer.Bytes()
+	}
+
+	var last, inventoried time.Time
+	var missed int
+	var burst time.Time // end of a requested burst
+	var replies []*ControlRequest // waiting for the next message
+	base_interval, base_sched := interval, sched
+	next := AlignTime(time.Now(), interval)
+	for {
+		var req *ControlRequest
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case req = <-requests:
+			timer.Stop()
+		}
+
+		now := time.Now()
+		scheduled := next
+		if req != nil && req.command == CTL_BURST {
+			interval = time.Duration(req.interval_ms) * time.Millisecond
+			lm.SetInterval(interval, req.Schedule(base_sched))
+			burst = now.Add(time.Duration(req.duration) * time.Second)
+			log.Printf("burst from %s: interval %v for %v", req.addr, interval, burst.Sub(now))
+			replies = append(replies, req)
+			next = AlignTime(now, interval)
+			continue
+		}
+		if req == nil && !burst.IsZero() && !now.Before(burst) {
+			interval = base_interval
+			lm.SetInterval(interval, base_sched)
+			burst = time.Time{}
+			log.Printf("burst ended, interval %v", interval)
+			next = AlignTime(now, interval)
+			continue
+		}
+
+		if req != nil {
+			// snapshot, probe all of the enabled probes off schedule
+			sched := lm.Schedule
+			lm.Schedule = make(map[uint8]int)
+			for spcode,multiple := range sched {
+				if multiple == 0 { lm.Schedule[spcode] = 0 }
+			}
+			if err := lm.Probe(); err != nil { fmt.Println("Warning: probe failed:", err) }
+			lm.Schedule = sched
+			scheduled = now
+			replies = append(replies, req)
+		} else {
+			lm.Tick = int(next.UnixNano() / int64(interval))
+			if err := lm.Probe(); err != nil { fmt.Println("Warning: probe failed:", err) }
+		}
+		lm.Timing.delay_ms = uint32(now.Sub(scheduled) / time.Millisecond)
+		lm.Timing.window_ms = 0
+		if !last.IsZero() { lm.Timing.window_ms = uint32(now.Sub(last) / time.Millisecond) }
+		lm.Timing.missed = uint16(missed)
+		lm.Present[SPC_Timing] = true
+		lm.Present[SPC_Identity] = true
+		lm.Sequence ++
+		last = now
+		msg := send(&lm)
+		for _,req := range replies {
+			if err := req.Reply(msg); err != nil { fmt.Println("Error reply to", req.addr, err) }
+		}
+		replies = nil
+
+		// the inventory goes in messages of its own, which only carry the
+		// identity besides it, so that the load messages stay small
+		if inventoried.IsZero() || (*f_inventory > 0 && now.Sub(inventoried) >= time.Duration(*f_inventory) * time.Minute) {
+			if err := lm.Inventory.Probe(); err != nil { fmt.Println("Warning: inventory failed:", err) }
+			for _,part := range lm.Inventory.Parts() {
+				lm.Sequence ++
+				im := LoadMessage{Interval:lm.Interval, Interval_ms:lm.Interval_ms,
+					Timestamp:lm.Timestamp, Timestamp_ms:lm.Timestamp_ms,
+					Boot_id:lm.Boot_id, Sequence:lm.Sequence,
+					Present:map[uint8]bool{SPC_Identity:true, SPC_Inventory:true},
+					Identity:lm.Identity, Inventory:part}
+				send(&im)
+			}
+			inventoried = now
 		}
 		lm.ProbeRotate()
+
+		// a snapshot leaves the schedule as it is
+		if req != nil { continue }
+		// skip the ticks passed while probing instead of drifting
+		for missed, next = 0, next.Add(interval); !next.After(time.Now()); next = next.Add(interval) {
+			missed ++
+		}
+		if missed > 0 { fmt.Printf("Warning: probe overrun, missed %d ticks\n", missed) }
 	}
 }
 
-func Receiver(port int, peers []LoadPeer) {
-	var lm LoadMessage
+// Receiver takes the messages of the peers, the messages relayed by the
+// downstream relays, and those of unknown senders if acc is not nil, and
+// forwards them upstream if relay is not nil. A reader queues the received
+// packets, a dispatcher passes them to a worker per peer which verifies,
+// decodes and logs them.
+func Receiver(listen string, peers, relays []LoadPeer, filter TagFilter, acc *Acceptor, relay *Relay, requests <-chan *ControlRequest) {
+	var agg *Aggregator
+	var dropped uint64 // by the reader, the queue being full
+	var kernel_dropped uint64
 
-	buf := make([]byte, 2000) // max should be 1500
-	conn,err := net.ListenUDP("udp", &net.UDPAddr{Port:port})
+	// shared by the workers
+	var lock sync.Mutex
+	logs := make(map[string]*LogFile) // by sender identity
+	stats := make(map[string]*LossStats)
+	liveness := make(LivenessTable)
+	clocks := make(map[string]*ClockStats)
+	owners := make(map[string]int) // peers received a sender from
+	hosts := make(map[string]*LoadPeer) // peers by the host id of their messages, see HostID
+	inventories := make(InventoryParts)
+
+	// the configured peers are expected on the local interval until they
+	// tell theirs, except the multicast groups
+	for i := range peers {
+		if !peers[i].Addr().IP.IsMulticast() { liveness.Expect(peers[i].name, MonitorInterval()) }
+	}
+
+	if *f_group != "" { agg = NewAggregator(*f_group) }
+	reported := time.Now()
+	stats_reported := time.Now()
+
+	var conn *net.UDPConn
+	laddr,err := net.ResolveUDPAddr("udp", listen)
+	if err == nil { conn,err = net.ListenUDP("udp", laddr) }
 	if err != nil {
-		fmt.Println("Failed listen UDP")
+		fmt.Println("Failed listen UDP:", err)
 		return
 	}
+	if *f_rcvbuf > 0 {
+		if err = conn.SetReadBuffer(*f_rcvbuf); err != nil { fmt.Println("Warning: failed set receive buffer:", err) }
+	}
+	if *f_mcast_groups != "" {
+		for _,group := range strings.Split(*f_mcast_groups, ",") {
+			if err = JoinMulticast(conn, net.ParseIP(strings.Trim(group, "[]"))); err != nil {
+				fmt.Println("Failed join multicast group", group, err)
+				return
+			}
+		}
+	}
+	packets := make(chan Packet, *f_queue)
+	go ReadUDP(conn, packets, &dropped)
+	if *f_listen_stream != "" {
+		if err = ListenStream(*f_listen_stream, listen, packets); err != nil {
+			fmt.Println("Failed listen", *f_listen_stream, err)
+			return
+		}
+	}
+
+	// deliver takes a message of pkt.ip, received from peer or relayed by
+	// it, lm belongs to the worker of the peer
+	deliver := func(lm *LoadMessage, pkt Packet, peer *LoadPeer, relayed bool) {
+		msg := pkt.buf
+		err := lm.Decode(bytes.NewReader(msg))
+		if err != nil { fmt.Println("Error decode packet:", err) }
+		if err == ErrChecksum { return }
+		// spooled messages are older, a replay is still dropped by its
+		// sequence number
+		window := time.Duration(*f_replay_window) * time.Second
+		if pkt.stream { window = time.Duration(*f_stream_replay_window) * time.Second }
+		if err == nil && (peer.key != nil || peer.seal != nil) && !lm.Fresh(window) {
+			fmt.Printf("Error packet from %s: timestamp out of the replay window\n", pkt.ip)
+			return
+		}
+		if len(filter) > 0 && (err != nil || !filter.Match(lm)) { return }
+		// the peer name does not change when its address does
+		name := peer.name
+		if relayed { name = pkt.ip.String() }
+		key := PeerKey(name, lm)
+		lock.Lock()
+		if !peer.keys[key] {
+			if peer.keys == nil { peer.keys = make(map[string]bool) }
+			peer.keys[key] = true
+			owners[key] ++
+		}
+		lock.Unlock()
+		if err == nil {
+			lock.Lock()
+			if id := HostID(lm); id != "" && !relayed { hosts[id] = peer }
+			liveness.Seen(key, time.Duration(lm.Interval_ms) * time.Millisecond)
+			// the peer was expected by its name, it is keyed by its identity
+			if live := liveness[peer.name]; !relayed && key != peer.name && live != nil && live.expected {
+				delete(liveness, peer.name)
+			}
+			if clocks[key] == nil { clocks[key] = &ClockStats{} }
+			clocks[key].Add(time.Since(lm.Time()))
+			clocks[key].Check(key, time.Duration(*f_skew * float64(time.Second)))
+			seq := SEQ_OK
+			if lm.Boot_id != 0 {
+				if stats[key] == nil { stats[key] = &LossStats{} }
+				seq = stats[key].Track(lm.Boot_id, lm.Sequence)
+			}
+			if agg != nil && seq != SEQ_DUPLICATE && seq != SEQ_STALE && !lm.Present[SPC_Inventory] { agg.Add(lm) }
+			lock.Unlock()
+
+			switch seq {
+			case SEQ_GAP: log.Printf("peer %s: messages lost before sequence %d", key, lm.Sequence)
+			case SEQ_REORDERED: log.Printf("peer %s: sequence %d arrived out of order", key, lm.Sequence)
+			case SEQ_RESTART: log.Printf("peer %s: sender restarted", key)
+			case SEQ_DUPLICATE:
+				log.Printf("peer %s: duplicate sequence %d dropped", key, lm.Sequence)
+				return
+			case SEQ_STALE:
+				log.Printf("peer %s: sequence %d of an older boot dropped", key, lm.Sequence)
+				return
+			}
+		}
+		if relay != nil && err == nil { relay.Forward(pkt.ip, msg) }
+		if (peer.auto || peer.relay) && !relayed && peer.logfile == nil && *f_key == "ip" && !*f_nolog {
+			now := time.Now()
+			logfile,lerr := OpenRotateLogFile(peer.name, &now, MODE_APPEND)
+			if lerr != nil {
+				fmt.Println("Error open log file:", lerr)
+			} else {
+				peer.logfile = logfile
+			}
+		}
+		var logfile *LogFile
+		if !relayed { logfile = peer.logfile }
+		if (relayed || *f_key != "ip") && !*f_nolog {
+			lock.Lock()
+			if logs[key] == nil {
+				now := time.Now()
+				logfile,lerr := OpenRotateLogFile(key, &now, MODE_APPEND)
+				if lerr != nil {
+					fmt.Println("Error open log file:", lerr)
+				} else {
+					logs[key] = logfile
+				}
+			}
+			logfile = logs[key]
+			lock.Unlock()
+		}
+		if logfile != nil { logfile.WriteMessage(msg) }
+		if err == nil && lm.Present[SPC_Inventory] && !*f_nolog {
+			lock.Lock()
+			parts := inventories.Add(key, lm, msg)
+			lock.Unlock()
+			if parts != nil { SaveInventory(key, parts) }
+		}
+	}
+
+	// the messages of the downstream relays are spread on a few workers by
+	// their sender, which keeps the messages of a sender in order
+	var relayed [RelayWorkers]chan RelayedPacket
+	if len(relays) > 0 {
+		for i := range relayed {
+			relayed[i] = make(chan RelayedPacket, WorkerQueueSize)
+			go func(queue <-chan RelayedPacket) {
+				var lm LoadMessage
+				for rpkt := range queue { deliver(&lm, rpkt.Packet, rpkt.relay, true) }
+			}(relayed[i])
+		}
+	}
+
+	receive := func(lm *LoadMessage, pkt Packet, peer *LoadPeer) {
+		msg,err := Verify(pkt.buf, peer.key)
+		if err == nil { msg,err = Open(msg, peer.seal) }
+		if err != nil {
+			fmt.Printf("Error verify packet from %s: %v\n", pkt.ip, err)
+			return
+		}
+		if len(msg) == 0 || msg[0] != ENV_RELAYED {
+			deliver(lm, Packet{ip:pkt.ip, buf:msg, stream:pkt.stream}, peer, false)
+			return
+		}
+		// anyone else could pass their messages for another sender
+		if !peer.relay {
+			log.Printf("peer %s: relayed packet from a peer not in -Ur dropped", peer.name)
+			return
+		}
+		rpkts,err := Unrelay(msg)
+		if err != nil {
+			fmt.Printf("Error relayed packet from %s: %v\n", pkt.ip, err)
+			return
+		}
+		for _,rpkt := range rpkts {
+			rpkt.stream = pkt.stream
+			h := fnv.New32a()
+			h.Write(rpkt.ip)
+			// the stream of the relay waits rather than losing acked records
+			queue := relayed[h.Sum32() % RelayWorkers]
+			if pkt.stream {
+				queue <- RelayedPacket{rpkt, peer}
+				continue
+			}
+			select {
+			case queue <- RelayedPacket{rpkt, peer}:
+			default:
+				atomic.AddUint64(&peer.dropped, 1)
+			}
+		}
+	}
+
+	// valid tells whether the first packet of an unknown sender is
+	// verified and decoded before the sender is registered
+	var check LoadMessage
+	valid := func(pkt Packet, peer *LoadPeer) bool {
+		msg,err := Verify(pkt.buf, peer.key)
+		if err == nil { msg,err = Open(msg, peer.seal) }
+		if err == nil && len(msg) > 0 && msg[0] == ENV_RELAYED {
+			err = errors.New("relayed packet from a sender not in -Ur")
+		} else if err == nil {
+			err = check.Decode(bytes.NewReader(msg))
+		}
+		if err != nil { fmt.Printf("Error packet from unknown sender %s: %v\n", pkt.ip, err) }
+		return err == nil
+	}
+
+	// identify finds the known peer of a packet from a new address by the
+	// identity of its message. The packet must verify with the keys of the
+	// peer, peers without keys are only followed to an address accepted by
+	// -A.
+	identify := func(pkt Packet) *LoadPeer {
+		accepted := acc != nil && acc.Allowed(pkt.ip)
+		match := func(peer *LoadPeer) bool {
+			if peer.key == nil && peer.seal == nil && !accepted { return false }
+			msg,err := Verify(pkt.buf, peer.key)
+			if err == nil { msg,err = Open(msg, peer.seal) }
+			if err != nil || len(msg) == 0 || msg[0] == ENV_RELAYED { return false }
+			if check.Decode(bytes.NewReader(msg)) != nil { return false }
+			id := HostID(&check)
+			if id == "" { return false }
+			lock.Lock()
+			defer lock.Unlock()
+			// a configured peer may not have sent anything yet
+			return hosts[id] == peer || (hosts[id] == nil && !peer.auto && peer.name == check.Identity.hostname)
+		}
+
+		for i := range peers {
+			if !peers[i].Addr().IP.IsMulticast() && match(&peers[i]) { return &peers[i] }
+		}
+		var auto []*LoadPeer
+		lock.Lock()
+		for _,peer := range hosts {
+			if peer.auto { auto = append(auto, peer) }
+		}
+		lock.Unlock()
+		for _,peer := range auto {
+			if match(peer) { return peer }
+		}
+		return nil
+	}
+	moved := make(map[string]*LoadPeer) // peers by their new address
+
+	// a worker keeps the messages of its peer in order, the log file and
+	// the state of the senders of the peer are dropped when it expires,
+	// unless another peer also received them
+	work := func(peer *LoadPeer, queue <-chan Packet) {
+		var lm LoadMessage
+		for pkt := range queue {
+			receive(&lm, pkt, peer)
+			if pkt.done != nil { pkt.done <- true }
+		}
+		if peer.logfile != nil { peer.logfile.Close() }
+
+		lock.Lock()
+		defer lock.Unlock()
+		for id,p := range hosts {
+			if p == peer { delete(hosts, id) }
+		}
+		for key := range peer.keys {
+			if owners[key] --; owners[key] > 0 { continue }
+			delete(owners, key)
+			if logs[key] != nil { logs[key].Close() }
+			delete(logs, key)
+			delete(stats, key)
+			delete(clocks, key)
+			delete(liveness, key)
+			delete(inventories, key)
+		}
+	}
+	workers := make(map[*LoadPeer]chan Packet)
+
+	// flushes the relay, checks and expires the peers without traffic
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	checked := time.Now()
 
 	for {
-		n,addr,err := conn.ReadFromUDP(buf)
-		if err != nil { continue }
-		if n == len(buf) { fmt.Println("Warning: received very long packet") }
+		select {
+		case pkt := <-packets:
+			var peer *LoadPeer
+			for i := range peers {
+				if pkt.ip.Equal(peers[i].Addr().IP) {
+					peer = &peers[i]
+					break
+				}
+			}
+			for i := range relays {
+				if peer == nil && pkt.ip.Equal(relays[i].Addr().IP) { peer = &relays[i] }
+			}
+			if peer == nil && acc != nil { peer = acc.Peer(pkt.ip) }
+			if peer == nil {
+				if peer = moved[pkt.ip.String()]; peer != nil && peer.auto { peer.seen = time.Now() }
+			}
+			// the host of a known peer sends from another address
+			if peer == nil {
+				if peer = identify(pkt); peer != nil {
+					log.Printf("peer %s: now sending from %s", peer.name, pkt.ip)
+					moved[pkt.ip.String()] = peer
+				}
+			}
+			if peer == nil && acc != nil {
+				if peer = acc.Candidate(pkt.ip); peer != nil && valid(pkt, peer) {
+					acc.Register(peer)
+				} else {
+					peer = nil
+				}
+			}
+			if peer == nil {
+				// a stream record is not acked, its connection is closed
+				if pkt.done != nil { pkt.done <- false }
+				break
+			}
+			if workers[peer] == nil {
+				workers[peer] = make(chan Packet, WorkerQueueSize)
+				go work(peer, workers[peer])
+			}
+			// a slow peer does not hold the others, the sender of a dropped
+			// stream record writes it again on a new connection
+			select {
+			case workers[peer] <- pkt:
+			default:
+				atomic.AddUint64(&peer.dropped, 1)
+				if pkt.done != nil { pkt.done <- false }
+			}
+			continue
+		case req := <-requests:
+			var table bytes.Buffer
+			lock.Lock()
+			liveness.Dump(&table)
+			lock.Unlock()
+			if err := req.ReplyText(table.Bytes()); err != nil { fmt.Println("Error reply to", req.addr, err) }
+			continue
+		case <-ticker.C:
+		}
 
-		for _,peer := range peers {
-			if !addr.IP.Equal(peer.addr.IP) { continue }
-			err = lm.Decode(bytes.NewReader(buf[:n]))
-			if err != nil { fmt.Println("Error decode packet:", err) }
-			if peer.logfile != nil { peer.logfile.WriteMessage(buf[:n]) }
-			break
+		if time.Since(checked) >= LivenessCheckInterval {
+			lock.Lock()
+			liveness.Check(*f_late, *f_down)
+			lock.Unlock()
+			checked = time.Now()
+		}
+		if relay != nil { relay.FlushDue() }
+		if acc != nil {
+			for _,peer := range acc.Expire() {
+				if workers[peer] != nil { close(workers[peer]) }
+				delete(workers, peer)
+				for ip,p := range moved {
+					if p == peer { delete(moved, ip) }
+				}
+			}
+		}
+
+		if agg != nil && time.Since(reported) >= time.Duration(*f_group_interval) * time.Second {
+			fmt.Println()
+			lock.Lock()
+			agg.Dump(os.Stdout)
+			agg.Reset()
+			lock.Unlock()
+			reported = time.Now()
+		}
+		if *f_stats_interval > 0 && time.Since(stats_reported) >= time.Duration(*f_stats_interval) * time.Second {
+			fmt.Println()
+			lock.Lock()
+			DumpLossStats(os.Stdout, stats)
+			DumpClockStats(os.Stdout, clocks)
+			lock.Unlock()
+			DumpPeerDrops(os.Stdout, workers)
+
+			drops, err := KernelDrops(conn)
+			if err != nil { fmt.Println("Warning: kernel drops unknown:", err) }
+			if drops > kernel_dropped { log.Printf("receiver: %d datagrams dropped by the kernel, raise -rb", drops - kernel_dropped) }
+			kernel_dropped = drops
+			fmt.Printf("receiver: dropped %d in the kernel, %d in the queue\n", drops, atomic.LoadUint64(&dropped))
+			stats_reported = time.Now()
 		}
 	}
 }
 
-func DumpLogFile(filename string) {
+// DumpPeerDrops reports the peers whose packets were dropped by the
+// receiver, their queue being full
+func DumpPeerDrops(w io.Writer, workers map[*LoadPeer]chan Packet) {
+	drops := make(map[string]uint64)
+	names := make([]string, 0)
+	for peer := range workers {
+		if n := atomic.LoadUint64(&peer.dropped); n > 0 {
+			drops[peer.name] = n
+			names = append(names, peer.name)
+		}
+	}
+	sort.Strings(names)
+
+	for _,name := range names {
+		fmt.Fprintf(w, "peer %s: dropped %d in its queue\n", name, drops[name])
+	}
+}
+
+// SaveInventory replaces the last inventory of a peer, kept in a log file
+// next to its load logs, with the messages carrying the parts of a new one
+func SaveInventory(key string, parts [][]byte) {
+	logfile,err := OpenLogFile(key + "-inventory.log", MODE_REWRITE)
+	if err != nil {
+		fmt.Println("Error open inventory file:", err)
+		return
+	}
+	defer logfile.Close()
+	for _,buf := range parts { logfile.WriteMessage(buf) }
+}
+
+func DumpLogFile(filename string, filter TagFilter, agg *Aggregator) {
 	var lm LoadMessage
 
 	logfile,err := OpenLogFile(filename, MODE_READ)
@@ -81,15 +625,33 @@ func DumpLogFile(filename string) {
 		fmt.Println("Error open log file:", err)
 		return
 	}
+	defer logfile.Close()
 
+	var clock ClockStats
 	for {
-		ts,buffer,err := logfile.ReadMessage()
+		var ts uint32
+		var buffer []byte
+		ts,buffer,err = logfile.ReadMessage()
+		if cerr,ok := err.(*CorruptRecordError); ok {
+			fmt.Println("Warning:", cerr)
+			continue
+		}
 		if err != nil { break }
 		t := FromTimestamp(ts).Format("20060102-150405")
-		err = lm.Decode(bytes.NewReader(buffer))
-		if err != nil {
-			fmt.Println("Error decode packet:", err)
-			break
+		if derr := lm.Decode(bytes.NewReader(buffer)); derr != nil {
+			fmt.Println("Error decode packet:", derr)
+			continue
+		}
+		// the local timestamp is in seconds, half a second on average
+		// before the message was written, the offset is only known to
+		// the second
+		clock.Add(FromTimestamp(ts).Add(500 * time.Millisecond).Sub(lm.Time()))
+		if *f_skew_correct { lm.Offset = clock.Offset().Round(time.Second) }
+		if !filter.Match(&lm) { continue }
+		if agg != nil {
+			if lm.Present[SPC_Inventory] { continue }
+			agg.Add(&lm)
+			continue
 		}
 
 		fmt.Println()
@@ -104,14 +666,66 @@ func DumpLogFile(filename string) {
 	if err != nil && err != io.EOF { fmt.Println(err) }
 }
 
-var f_readfile = flag.String("r", "", "decode log file")
+var f_readfile = flag.String("r", "", "decode log files, comma separated")
+var f_filter = flag.String("f", "", "only show or log messages of hosts with all these labels, comma separated key=value")
+var f_group = flag.String("g", "", "summarize messages grouped by the value of this label")
+var f_group_interval = flag.Int("gi", 60, "seconds between two group summaries in server mode")
+var f_stats_interval = flag.Int("si", 60, "seconds between two peer loss statistics in server mode, 0 disables")
 var f_server = flag.Bool("l", false, "server mode")
 var f_port = flag.Int("p", 9999, "udp port to listen and (default) send")
-var f_peers = flag.String("P", "", "peers, comma separated ipaddr[:port]")
+var f_listen = flag.String("b", "", "server and control listen address, ipv4 or ipv6, all addresses by default")
+var f_mcast_groups = flag.String("j", "", "multicast groups joined by the server, comma separated, -b must not be a unicast address")
+var f_mcast_ttl = flag.Int("mttl", 1, "TTL, or hop limit, of the messages sent to multicast peers")
+var f_mcast_if = flag.String("mif", "", "interface of the multicast messages and groups, chosen by the routes by default")
+var f_upstream = flag.String("U", "", "relay the received messages to these servers, same syntax as -P")
+var f_relays = flag.String("Ur", "", "take relayed messages from these downstream relays only, same syntax as -P")
+var f_relay_batch = flag.Int("Ub", 1, "messages batched in a relayed packet, at most 255")
+var f_relay_delay = flag.Int("Ud", 1000, "milliseconds a message may wait for a batch")
+var f_relay_subpackets = flag.String("Us", "", "only relay these subpackets, comma separated (proc,cpu,mem,io,net,numa,custom,timing,status,identity,inventory)")
+var f_control_listen = flag.Bool("c", false, "take control requests of the servers sharing a key, on the -cp port")
+var f_control_port = flag.Int("cp", 9998, "udp port of the control requests")
+var f_control = flag.String("C", "", "send the -Cr control request to this host[:port] and show the reply")
+var f_control_request = flag.String("Cr", "snapshot", "control request: snapshot, burst:<interval ms>:<seconds>[:probe,...] to a sender, or peers to a server")
+var f_skew = flag.Float64("skew", 2, "seconds of clock skew of a peer reported by the server, 0 disables")
+var f_skew_correct = flag.Bool("sc", false, "show the timestamps of decoded log files (-r) on the receiver clock")
+var f_late = flag.Float64("late", 2, "intervals without message before a peer is late")
+var f_down = flag.Float64("down", 5, "intervals without message before a peer is down")
+var f_peers = flag.String("P", "", "peers, comma separated [udp|tcp|tls://]host[:port], ipv6 addresses in brackets")
+var f_resolve = flag.Int("R", 5, "minutes between two lookups of the peers given by hostname, 0 disables")
+var f_accept = flag.String("A", "", "server accepts unknown senders from these networks, comma separated CIDRs or \"any\"")
+var f_accept_idle = flag.Int("Ai", 60, "minutes before an idle accepted sender is forgotten, 0 keeps them")
+var f_rcvbuf = flag.Int("rb", 0, "server udp receive buffer in bytes, the system default if 0")
+var f_queue = flag.Int("q", 4096, "packets queued between the server reader and the peer workers")
+var f_listen_stream = flag.String("t", "", "server also accepts tcp or tls connections on the port")
+var f_spool_dir = flag.String("spool", "", "directory keeping messages to unreachable tcp or tls peers")
+var f_spool_size = flag.Int("spoolsize", 64, "maximum spool size per peer in MB")
+var f_spool_age = flag.Int("spoolage", 60, "minutes spooled messages are kept, -rws of the servers should cover it for signed peers")
+var f_tls_cert = flag.String("tlscert", "", "tls certificate, of the server or the client")
+var f_tls_key = flag.String("tlskey", "", "tls private key of -tlscert")
+var f_tls_ca = flag.String("tlsca", "", "tls CA verifying the server, or required to verify the clients")
 var f_monitor = flag.Bool("m", true, "monitor local computer")
 var f_nolog = flag.Bool("n", true, "don't write log files on this node")
 var f_interval = flag.Int("i", 10, "local monitor interval")
+var f_interval_ms = flag.Int("im", 0, "local monitor interval in milliseconds, overrides -i")
+var f_schedule = flag.String("s", "", "probe schedule, comma separated probe[:multiple of -i], 0 disables (probes: proc,cpu,mem,io,net,numa,custom)")
 var f_verbose = flag.Int("v", 1, "verbose level")
+var f_inventory = flag.Int("inv", 60, "minutes between two host inventories, 0 sends it only at startup")
+var f_keyfile = flag.String("K", "", "file of \"peer hexkey\" lines, signs messages with HMAC-SHA256 for these peers")
+var f_sealfile = flag.String("E", "", "file of \"peer keyid hexkey\" lines, encrypts messages with AES-256-GCM for these peers")
+var f_replay_window = flag.Int("rw", 30, "seconds a signed or encrypted message is accepted after its source timestamp")
+var f_stream_replay_window = flag.Int("rws", 3900, "seconds a signed or encrypted message received over tcp or tls is accepted, covering the spool age of the senders")
+var f_labels = flag.String("L", "", "host labels, comma separated key=value")
+var f_label_file = flag.String("Lf", "", "file of host labels, one key=value per line")
+var f_key = flag.String("k", "ip", "name peer logs and statistics by ip, hostname or machineid")
+var f_plugins = flag.String("x", "", "exec plugins, comma separated commands printing \"name value\" lines")
+var f_plugin_timeout = flag.Int("xt", 5, "exec plugin timeout in seconds")
+var f_metrics_socket = flag.String("u", "", "unix datagram socket receiving \"name:value|c\" or \"name:value|g\" metrics")
+
+// MonitorInterval is the interval of the local monitor, -im or -i
+func MonitorInterval() time.Duration {
+	if *f_interval_ms > 0 { return time.Duration(*f_interval_ms) * time.Millisecond }
+	return time.Duration(*f_interval) * time.Second
+}
 
 func main() {
 	var err error
@@ -120,29 +734,105 @@ func main() {
 	now := time.Now()
 	flag.Parse()
 
+	labels, err := ParseLabels(*f_filter)
+	if err != nil { log.Fatal("invalid filter:", err) }
+	filter := TagFilter(labels)
+
 	if *f_readfile != "" {
-		DumpLogFile(*f_readfile)
+		var agg *Aggregator
+		if *f_group != "" { agg = NewAggregator(*f_group) }
+		for _,filename := range strings.Split(*f_readfile, ",") {
+			DumpLogFile(filename, filter, agg)
+		}
+		if agg != nil { agg.Dump(os.Stdout) }
 		return
 	}
 
-	if len(*f_peers) > 0 {
-		s := strings.Split(*f_peers, ",")
-		peers = make([]LoadPeer, len(s))
-		for i,ss := range s {
-			if strings.Index(ss, ":") < 0 { ss = fmt.Sprintf("%s:%d", ss, *f_port) }
-			peers[i].addr,err = net.ResolveUDPAddr("udp", ss)
-			if err != nil { log.Fatal("invalid peer address:", ss) }
-			peers[i].conn,err = net.DialUDP("udp", nil, peers[i].addr)
-			if err != nil { log.Fatal("failed connect to udp:", peers[i].addr) }
-			if *f_server && !*f_nolog {
-				peers[i].logfile,err = OpenRotateLogFile(peers[i].addr.IP.String(), &now, MODE_APPEND)
-				if err != nil { log.Fatal("failed open logfile:", err) }
-			}
+	if *f_key != "ip" && *f_key != "hostname" && *f_key != "machineid" {
+		log.Fatal("invalid peer key:", *f_key)
+	}
+	if *f_listen_stream != "" && *f_listen_stream != "tcp" && *f_listen_stream != "tls" {
+		log.Fatal("invalid stream protocol:", *f_listen_stream)
+	}
+	if *f_queue < 1 {
+		log.Fatal("invalid receiver queue size:", *f_queue)
+	}
+	if *f_interval_ms < 0 || (*f_interval_ms == 0 && *f_interval <= 0) {
+		log.Fatal("invalid monitor interval, should be positive")
+	}
+	if *f_plugin_timeout <= 0 {
+		log.Fatal("invalid plugin timeout, should be positive")
+	}
+
+	var keys KeyRing
+	if *f_keyfile != "" {
+		keys,err = LoadKeys(*f_keyfile)
+		if err != nil { log.Fatal("failed load keys:", err) }
+	}
+	var seals SealRing
+	if *f_sealfile != "" {
+		seals,err = LoadSealKeys(*f_sealfile)
+		if err != nil { log.Fatal("failed load encryption keys:", err) }
+	}
+
+	if *f_control != "" {
+		req,err := ParseControl(*f_control_request)
+		if err != nil { log.Fatal(err) }
+		_,_,hostport,err := SplitPeer(*f_control, *f_control_port)
+		if err != nil { log.Fatal(err) }
+		msg,err := SendControl(hostport, req, keys, seals)
+		if err != nil { log.Fatal("control request failed: ", err) }
+		if req.command == CTL_PEERS {
+			os.Stdout.Write(msg)
+			return
 		}
+		var lm LoadMessage
+		if err = lm.Decode(bytes.NewReader(msg)); err != nil { log.Fatal("invalid reply: ", err) }
+		lm.Dump(os.Stdout)
+		return
+	}
+
+	peers,err = ParsePeers(*f_peers, keys, seals, *f_monitor)
+	if err != nil { log.Fatal(err) }
+	for i := range peers {
+		if *f_server && !*f_nolog && *f_key == "ip" {
+			peers[i].logfile,err = OpenRotateLogFile(strings.Replace(peers[i].name, "/", "_", -1), &now, MODE_APPEND)
+			if err != nil { log.Fatal("failed open logfile:", err) }
+		}
+	}
+
+	listen_host := strings.TrimSuffix(strings.TrimPrefix(*f_listen, "["), "]")
+	var requests, server_requests chan *ControlRequest
+	if *f_control_listen {
+		routes := make(map[uint8]chan<- *ControlRequest)
+		if *f_monitor {
+			requests = make(chan *ControlRequest)
+			routes[CTL_SNAPSHOT], routes[CTL_BURST] = requests, requests
+		}
+		if *f_server {
+			server_requests = make(chan *ControlRequest)
+			routes[CTL_PEERS] = server_requests
+		}
+		err = ListenControl(net.JoinHostPort(listen_host, strconv.Itoa(*f_control_port)), keys, seals, routes)
+		if err != nil { log.Fatal("failed listen control requests:", err) }
 	}
 
 	if *f_server {
-		go Receiver(*f_port, peers)
+		listen := net.JoinHostPort(listen_host, strconv.Itoa(*f_port))
+		var acc *Acceptor
+		if *f_accept != "" {
+			acc,err = NewAcceptor(*f_accept, keys, seals, time.Duration(*f_accept_idle) * time.Minute)
+			if err != nil { log.Fatal("invalid accepted networks:", err) }
+		}
+		var relay *Relay
+		if *f_upstream != "" {
+			relay,err = NewRelay(*f_upstream, keys, seals)
+			if err != nil { log.Fatal(err) }
+		}
+		relays,err := ParsePeers(*f_relays, keys, seals, false)
+		if err != nil { log.Fatal(err) }
+		for i := range relays { relays[i].relay = true }
+		go Receiver(listen, peers, relays, filter, acc, relay, server_requests)
 	}
 
 	if *f_monitor {
@@ -150,7 +840,7 @@ func main() {
 		hostname,err := os.Hostname()
 		if err != nil { hostname = "localhost" }
 		if !*f_nolog { logfile,err = OpenRotateLogFile(hostname, &now, MODE_APPEND) }
-		Sender(*f_interval, logfile, peers)
+		Sender(MonitorInterval(), logfile, peers, requests)
 	} else {
 		for { time.Sleep(1 * time.Second) }
 	}
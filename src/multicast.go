@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+func MulticastInterface() (*net.Interface, error) {
+	if *f_mcast_if == "" { return nil, nil }
+	return net.InterfaceByName(*f_mcast_if)
+}
+
+// control runs f on the socket of conn
+func control(conn *net.UDPConn, f func(fd int) error) error {
+	rc, err := conn.SyscallConn()
+	if err != nil { return err }
+	var serr error
+	if err = rc.Control(func(fd uintptr) { serr = f(int(fd)) }); err != nil { return err }
+	return serr
+}
+
+// SetMulticast sets the TTL, or hop limit, and the interface of the
+// messages sent to group on conn
+func SetMulticast(conn *net.UDPConn, group net.IP) error {
+	ifi, err := MulticastInterface()
+	if err != nil { return err }
+
+	return control(conn, func(fd int) error {
+		if group.To4() != nil {
+			err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, *f_mcast_ttl)
+			if err != nil || ifi == nil { return err }
+			return syscall.SetsockoptIPMreqn(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF,
+				&syscall.IPMreqn{Ifindex:int32(ifi.Index)})
+		}
+		err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, *f_mcast_ttl)
+		if err != nil || ifi == nil { return err }
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index)
+	})
+}
+
+// JoinMulticast subscribes the listening conn to group, which must not be
+// bound to a unicast address
+func JoinMulticast(conn *net.UDPConn, group net.IP) error {
+	if !group.IsMulticast() { return &net.AddrError{Err:"not a multicast address", Addr:group.String()} }
+	ifi, err := MulticastInterface()
+	if err != nil { return err }
+
+	return control(conn, func(fd int) error {
+		if ip4 := group.To4(); ip4 != nil {
+			mreq := &syscall.IPMreqn{}
+			copy(mreq.Multiaddr[:], ip4)
+			if ifi != nil { mreq.Ifindex = int32(ifi.Index) }
+			return syscall.SetsockoptIPMreqn(fd, syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+		}
+		mreq := &syscall.IPv6Mreq{}
+		copy(mreq.Multiaddr[:], group)
+		if ifi != nil { mreq.Interface = uint32(ifi.Index) }
+		return syscall.SetsockoptIPv6Mreq(fd, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+	})
+}
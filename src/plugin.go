@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"syscall"
+	"os/exec"
+	"./sutils"
+)
+
+// metric names longer than this are truncated so an item always fits in
+// a custom metrics subpacket
+const MetricMaxName = 200
+
+// bytes of custom metrics in a message, which must still fit in a datagram
+// with the other subpackets, see RelayMaxSize
+const CustomMaxSize = 600
+
+// time the output of a killed plugin is still waited for, its children
+// may keep stdout open
+const PluginWaitDelay = time.Second
+
+func ParseMetrics(buf []byte) (items []MetricItem) {
+	sutils.ReadLines(bytes.NewReader(buf), func (line string) (err error) {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") { return }
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil { return nil }
+		name := fields[0]
+		if len(name) > MetricMaxName { name = name[:MetricMaxName] }
+		items = append(items, MetricItem{name:name, value:value})
+		return
+	})
+	return
+}
+
+// RunPlugin runs a plugin in a process group of its own, which is killed
+// as a whole when ctx is done
+func RunPlugin(ctx context.Context, plugin string) ([]MetricItem, error) {
+	args := strings.Fields(plugin)
+	if len(args) == 0 { return nil, nil }
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid:true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = PluginWaitDelay
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		err = fmt.Errorf("CustomLoad.Probe: plugin %s timed out", args[0])
+	} else if err != nil {
+		err = fmt.Errorf("CustomLoad.Probe: plugin %s failed: %v", args[0], err)
+	}
+
+	// keep whatever the plugin printed before it failed
+	return ParseMetrics(out), err
+}
+
+func (load *CustomLoad) Probe() (err error) {
+	var wg sync.WaitGroup
+
+	ctx, cancel := context.WithTimeout(context.Background(), load.Timeout)
+	defer cancel()
+
+	items := make([][]MetricItem, len(load.Plugins))
+	errs := make([]error, len(load.Plugins))
+	for i, plugin := range load.Plugins {
+		wg.Add(1)
+		go func(i int, plugin string) {
+			defer wg.Done()
+			items[i], errs[i] = RunPlugin(ctx, plugin)
+		}(i, plugin)
+	}
+	wg.Wait()
+
+	load.Items = nil
+	for i := range load.Plugins {
+		load.Items = append(load.Items, items[i]...)
+		if err == nil { err = errs[i] }
+	}
+	if load.Listener != nil { load.Items = append(load.Items, load.Listener.Flush()...) }
+	if dropped := load.Cap(); dropped > 0 {
+		fmt.Printf("Warning: %d custom metrics dropped, beyond %d bytes in a message\n", dropped, CustomMaxSize)
+	}
+	return
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"reflect"
+	"path/filepath"
+)
+
+func TestParseMetrics(t *testing.T) {
+	long := strings.Repeat("n", MetricMaxName + 10)
+	out := "# comment 1\nfoo 1.5\n\nbar  -2\nbad value\ntoo many fields\n" + long + " 3\nlast 4"
+	want := []MetricItem{
+		{name:"foo", value:1.5},
+		{name:"bar", value:-2},
+		{name:long[:MetricMaxName], value:3},
+		{name:"last", value:4},
+	}
+
+	if items := ParseMetrics([]byte(out)); !reflect.DeepEqual(items, want) { t.Errorf("got %v, want %v", items, want) }
+	if items := ParseMetrics(nil); len(items) != 0 { t.Errorf("got %v from no output", items) }
+}
+
+func TestRunPluginTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+	defer cancel()
+
+	// the child of the shell keeps stdout open
+	script := filepath.Join(t.TempDir(), "plugin.sh")
+	os.WriteFile(script, []byte("echo a 1\nsleep 5 &\nwait\n"), 0755)
+	start := time.Now()
+	items, err := RunPlugin(ctx, "sh " + script)
+	if err == nil { t.Errorf("no timeout error") }
+	if d := time.Since(start); d > 200 * time.Millisecond + PluginWaitDelay + time.Second { t.Errorf("plugin returned after %v", d) }
+	if len(items) != 1 || items[0].name != "a" { t.Errorf("got %v", items) }
+}
+
+func TestCustomLoadCap(t *testing.T) {
+	l := &MetricsListener{}
+	l.reset()
+	for i := 0; i < 500; i ++ { l.add(fmt.Sprintf("requests.%d:1|c", i)) }
+	load := CustomLoad{Listener:l, Timeout:time.Second}
+	load.Probe()
+	if n := len(load.Items); n == 0 || n >= 500 { t.Fatalf("%d metrics kept", n) }
+
+	m := LoadMessage{Present:map[uint8]bool{SPC_CustomMetrics:true}, Custom_load:load}
+	var w bytes.Buffer
+	m.Encode(&w)
+	if w.Len() > CustomMaxSize + 64 { t.Errorf("message of %d bytes", w.Len()) }
+
+	if dropped := load.Cap(); dropped != 0 { t.Errorf("%d dropped again", dropped) }
+}
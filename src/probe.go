@@ -4,10 +4,13 @@ import (
 	"os"
 	"fmt"
 	"bytes"
+	"sort"
+	"time"
 	"errors"
 	"strconv"
 	"strings"
 	"io/ioutil"
+	"path/filepath"
 	"./sutils"
 )
 
@@ -52,6 +55,19 @@ func (load *ProcLoad) Probe() error {
 	return nil
 }
 
+func (win *Window) Advance() {
+	now := time.Now()
+	if !win.Last.IsZero() { win.Elapsed = now.Sub(win.Last) }
+	win.Last = now
+}
+
+// Scale converts a counter delta over the elapsed time to the delta over
+// the nominal interval
+func (win *Window) Scale(delta int64) uint32 {
+	if win.Elapsed <= 0 || win.Interval <= 0 { return uint32(delta) }
+	return uint32(float64(delta) * float64(win.Interval) / float64(win.Elapsed) + 0.5)
+}
+
 func Fields2Int(fields []string, cols []int) (rslt []int64, err error) {
 	var r int64
 	for _, v := range cols {
@@ -65,7 +81,7 @@ func Fields2Int(fields []string, cols []int) (rslt []int64, err error) {
 func cpuload_getstat() (rslt [][4]int64, err error) {
 	file, err := os.Open("/proc/stat")
 	if err != nil {
-		fmt.Println(fmt.Errorf("CPULoad.Probe: failed open /proc/stat"))
+		err = fmt.Errorf("CPULoad.Probe: failed open /proc/stat")
 		return
 	}
 	defer file.Close()
@@ -83,6 +99,7 @@ func cpuload_getstat() (rslt [][4]int64, err error) {
 }
 
 func (load *CPULoad) ProbeInit() (err error) {
+	load.Advance()
 	rslt, err := cpuload_getstat()
 	load.Current = rslt
 	load.Items = make([]CPUItem, len(rslt))
@@ -94,9 +111,11 @@ func (load *CPULoad) Probe() (err error) {
 	var diff [4]float32
 
 	rslt, err := cpuload_getstat()
+	if err != nil { return }
 	if len(load.Current) != len(rslt) {
 		return errors.New("different CPU numbers")
 	}
+	load.Advance()
 
 	for i := 0; i < len(load.Current); i++ {
 		all = 0
@@ -104,6 +123,11 @@ func (load *CPULoad) Probe() (err error) {
 			diff[j] = float32(rslt[i][j] - load.Current[i][j])
 			all += diff[j]
 		}
+		if all == 0 {
+			// no tick elapsed in a very short interval
+			load.Items[i] = CPUItem{Rate_idle:255}
+			continue
+		}
 		load.Items[i].Rate_user = uint8(diff[0] / all * 255 + 0.5)
 		load.Items[i].Rate_sys = uint8(diff[1] / all * 255 + 0.5)
 		load.Items[i].Rate_iowait = uint8(diff[2] / all * 255 + 0.5)
@@ -117,7 +141,7 @@ func (load *CPULoad) Probe() (err error) {
 func (load *MemoryLoad) Probe() (err error) {
 	file, err := os.Open("/proc/meminfo")
 	if err != nil {
-		fmt.Println(fmt.Errorf("MemoryLoad.Probe: failed open /proc/meminfo"))
+		err = fmt.Errorf("MemoryLoad.Probe: failed open /proc/meminfo")
 		return
 	}
 	defer file.Close()
@@ -145,7 +169,7 @@ func (load *MemoryLoad) Probe() (err error) {
 func ioload_getstat() (rslt [][4]int64, names []string, err error) {
 	file, err := os.Open("/proc/diskstats")
 	if err != nil {
-		fmt.Println(fmt.Errorf("IOLoad.Probe: failed open /proc/diskstats"))
+		err = fmt.Errorf("IOLoad.Probe: failed open /proc/diskstats")
 		return
 	}
 	defer file.Close()
@@ -164,6 +188,7 @@ func ioload_getstat() (rslt [][4]int64, names []string, err error) {
 }
 
 func (load *IOLoad) ProbeInit() (err error) {
+	load.Advance()
 	rslt, _, err := ioload_getstat()
 	load.Current = rslt
 	load.Items = make([]DiskItem, len(rslt))
@@ -172,15 +197,17 @@ func (load *IOLoad) ProbeInit() (err error) {
 
 func (load *IOLoad) Probe() (err error) {
 	rslt, names, err := ioload_getstat()
+	if err != nil { return }
 	if len(load.Current) != len(rslt) {
 		return errors.New("different sdX numbers")
 	}
+	load.Advance()
 
 	for i := 0; i < len(load.Current); i++ {
-		load.Items[i].tps_read = uint32(rslt[i][0] - load.Current[i][0])
-		load.Items[i].kbytes_read = uint32(rslt[i][1] - load.Current[i][1])
-		load.Items[i].tps_written = uint32(rslt[i][2] - load.Current[i][2])
-		load.Items[i].kbytes_written = uint32(rslt[i][3] - load.Current[i][3])
+		load.Items[i].tps_read = load.Scale(rslt[i][0] - load.Current[i][0])
+		load.Items[i].kbytes_read = load.Scale(rslt[i][1] - load.Current[i][1])
+		load.Items[i].tps_written = load.Scale(rslt[i][2] - load.Current[i][2])
+		load.Items[i].kbytes_written = load.Scale(rslt[i][3] - load.Current[i][3])
 		load.Items[i].name = names[i]
 	}
 
@@ -191,7 +218,7 @@ func (load *IOLoad) Probe() (err error) {
 func network_getstat() (rslt [][4]int64, names []string, err error) {
 	file, err := os.Open("/proc/net/dev")
 	if err != nil {
-		fmt.Println(fmt.Errorf("Network.Probe: failed open /proc/net/dev"))
+		err = fmt.Errorf("Network.Probe: failed open /proc/net/dev")
 		return
 	}
 	defer file.Close()
@@ -210,6 +237,7 @@ func network_getstat() (rslt [][4]int64, names []string, err error) {
 }
 
 func (load *NetworkLoad) ProbeInit() (err error) {
+	load.Advance()
 	rslt, _, err := network_getstat()
 	load.Current = rslt
 	load.Items = make([]InterfaceItem, len(rslt))
@@ -218,15 +246,17 @@ func (load *NetworkLoad) ProbeInit() (err error) {
 
 func (load *NetworkLoad) Probe() (err error) {
 	rslt, names, err := network_getstat()
+	if err != nil { return }
 	if len(load.Current) != len(rslt) {
 		return errors.New("different network numbers")
 	}
+	load.Advance()
 
 	for i := 0; i < len(load.Current); i++ {
-		load.Items[i].kbytes_read = uint32(rslt[i][0] - load.Current[i][0])
-		load.Items[i].pkts_read = uint32(rslt[i][1] - load.Current[i][1])
-		load.Items[i].kbytes_written = uint32(rslt[i][2] - load.Current[i][2])
-		load.Items[i].pkts_written = uint32(rslt[i][3] - load.Current[i][3])
+		load.Items[i].kbytes_read = load.Scale(rslt[i][0] - load.Current[i][0])
+		load.Items[i].pkts_read = load.Scale(rslt[i][1] - load.Current[i][1])
+		load.Items[i].kbytes_written = load.Scale(rslt[i][2] - load.Current[i][2])
+		load.Items[i].pkts_written = load.Scale(rslt[i][3] - load.Current[i][3])
 		load.Items[i].name = names[i]
 	}
 
@@ -234,25 +264,205 @@ func (load *NetworkLoad) Probe() (err error) {
 	return nil
 }
 
+// the NUMA subpacket length is an uint8, which holds at most 11 nodes
+const NUMAMaxNodes = 11
+
+func numaload_getstat() (rslt [][5]int64, nodes []uint8, err error) {
+	dirs, err := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+	if err != nil { return }
+
+	ids := make([]int, 0, len(dirs))
+	for _, dir := range dirs {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil { continue }
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	if len(ids) > NUMAMaxNodes { ids = ids[:NUMAMaxNodes] }
+
+	for _, id := range ids {
+		var stat [5]int64
+		dir := fmt.Sprintf("/sys/devices/system/node/node%d", id)
+
+		file, err := os.Open(dir + "/meminfo")
+		if err != nil {
+			return nil, nil, fmt.Errorf("NUMALoad.Probe: failed open %s/meminfo", dir)
+		}
+		sutils.ReadLines(file, func (line string) (err error) {
+			// Node 0 MemFree:         3336736 kB
+			fields := strings.Fields(line)
+			if len(fields) < 4 { return }
+			value, err := strconv.ParseInt(fields[3], 0, 64)
+			if err != nil { return }
+			switch fields[2] {
+			case "MemFree:": stat[0] = value
+			case "FilePages:": stat[1] = value
+			case "AnonPages:": stat[2] = value
+			}
+			return
+		})
+		file.Close()
+
+		file, err = os.Open(dir + "/numastat")
+		if err != nil {
+			return nil, nil, fmt.Errorf("NUMALoad.Probe: failed open %s/numastat", dir)
+		}
+		sutils.ReadLines(file, func (line string) (err error) {
+			fields := strings.Fields(line)
+			if len(fields) < 2 { return }
+			value, err := strconv.ParseInt(fields[1], 0, 64)
+			if err != nil { return }
+			switch fields[0] {
+			case "numa_hit": stat[3] = value
+			case "numa_miss": stat[4] = value
+			}
+			return
+		})
+		file.Close()
+
+		rslt = append(rslt, stat)
+		nodes = append(nodes, uint8(id))
+	}
+	return
+}
+
+func (load *NUMALoad) ProbeInit() (err error) {
+	load.Advance()
+	rslt, _, err := numaload_getstat()
+	load.Current = make([][2]int64, len(rslt))
+	for i := range rslt {
+		load.Current[i] = [2]int64{rslt[i][3], rslt[i][4]}
+	}
+	load.Items = make([]NUMAItem, len(rslt))
+	return
+}
+
+func (load *NUMALoad) Probe() (err error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return fmt.Errorf("NUMALoad.Probe: failed open /proc/meminfo")
+	}
+	defer file.Close()
+
+	sutils.ReadLines(file, func (line string) (err error) {
+		fields := strings.Fields(line)
+		if len(fields) < 2 { return }
+		value, err := strconv.ParseInt(fields[1], 0, 32)
+		if err != nil { return }
+		switch fields[0] {
+		case "HugePages_Total:": load.hugepages_total = uint32(value)
+		case "HugePages_Free:": load.hugepages_free = uint32(value)
+		case "HugePages_Rsvd:": load.hugepages_rsvd = uint32(value)
+		}
+		return
+	})
+
+	rslt, nodes, err := numaload_getstat()
+	if err != nil { return }
+	if len(load.Current) != len(rslt) {
+		return errors.New("different NUMA node numbers")
+	}
+	load.Advance()
+
+	for i := 0; i < len(load.Current); i++ {
+		load.Items[i].node = nodes[i]
+		load.Items[i].memfree = uint32(rslt[i][0])
+		load.Items[i].filepages = uint32(rslt[i][1])
+		load.Items[i].anonpages = uint32(rslt[i][2])
+		load.Items[i].numa_hit = load.Scale(rslt[i][3] - load.Current[i][0])
+		load.Items[i].numa_miss = load.Scale(rslt[i][4] - load.Current[i][1])
+		load.Current[i] = [2]int64{rslt[i][3], rslt[i][4]}
+	}
+
+	return nil
+}
+
+// ParseSchedule parses "probe:multiple,..." where multiple is how many
+// intervals pass between two runs of the probe, 0 disables it, and probes
+// not listed run every interval
+func ParseSchedule(s string) (sched map[uint8]int, err error) {
+	sched = make(map[uint8]int)
+	if s == "" { return }
+
+	for _,ss := range strings.Split(s, ",") {
+		var found bool
+		var spcode uint8
+		multiple := 1
+
+		fields := strings.SplitN(ss, ":", 2)
+		for code,name := range ProbeNames {
+			if name == fields[0] { spcode, found = code, true }
+		}
+		if !found { return nil, fmt.Errorf("unknown probe %s", fields[0]) }
+		if len(fields) > 1 {
+			multiple, err = strconv.Atoi(fields[1])
+			if err != nil || multiple < 0 { return nil, fmt.Errorf("invalid multiple for probe %s", fields[0]) }
+		}
+		sched[spcode] = multiple
+	}
+	return
+}
+
+func (m *LoadMessage) multiple(spcode uint8) int {
+	if multiple,ok := m.Schedule[spcode]; ok { return multiple }
+	return 1
+}
+
 func (m *LoadMessage) ProbeInit() error {
-	m.Cpu_load.ProbeInit()
-	m.Io_load.ProbeInit()
-	m.Net_load.ProbeInit()
+	interval := time.Duration(m.Interval_ms) * time.Millisecond
+	m.Cpu_load.Interval = interval
+	m.Io_load.Interval = interval
+	m.Net_load.Interval = interval
+	m.Numa_load.Interval = interval
+
+	if m.multiple(SPC_CPULoad) > 0 { m.Cpu_load.ProbeInit() }
+	if m.multiple(SPC_IOLoad) > 0 { m.Io_load.ProbeInit() }
+	if m.multiple(SPC_NetworkLoad) > 0 { m.Net_load.ProbeInit() }
+	if m.multiple(SPC_NUMALoad) > 0 { m.Numa_load.ProbeInit() }
 	return nil
 }
 
+// SetInterval changes the monitor interval and the probe schedule, the
+// counters start again from the next probe
+func (m *LoadMessage) SetInterval(interval time.Duration, sched map[uint8]int) error {
+	m.Interval = uint16(interval / time.Second)
+	m.Interval_ms = uint32(interval / time.Millisecond)
+	m.Schedule = sched
+	return m.ProbeInit()
+}
+
 func (m *LoadMessage) ProbeRotate() error {
 	return nil
 }
 
-func (m *LoadMessage) Probe() error {
-	m.Timestamp = GetTimestamp()
+type Prober interface {
+	Probe() error
+}
 
-	if err := m.Proc_load.Probe(); err != nil { return err }
-	if err := m.Cpu_load.Probe(); err != nil { return err }
-	if err := m.Mem_load.Probe(); err != nil { return err }
-	if err := m.Io_load.Probe(); err != nil { return err }
-	if err := m.Net_load.Probe(); err != nil { return err }
+// Probe runs the probes due at this tick, the message then carries only
+// the subpackets of those which succeeded, failures are listed in the
+// status subpacket
+func (m *LoadMessage) Probe() (err error) {
+	now := time.Now()
+	m.Timestamp = ToTimestamp(now)
+	m.Timestamp_ms = uint16(now.Nanosecond() / 1000000)
+	m.Present = make(map[uint8]bool)
+	tick := m.Tick
+	m.Tick ++
+
+	m.Status.Items = nil
+	for _,spcode := range ProbeCodes {
+		multiple := m.multiple(spcode)
+		if multiple == 0 || tick % multiple != 0 { continue }
+		perr := m.Subpacket(spcode).(Prober).Probe()
+		if perr != nil {
+			m.Status.Items = append(m.Status.Items, ProbeError{spcode:spcode, message:perr.Error()})
+			if err == nil { err = perr }
+		}
+		// metrics of the plugins which succeeded are still valid
+		if perr == nil || spcode == SPC_CustomMetrics { m.Present[spcode] = true }
+	}
+	if len(m.Status.Items) > 0 { m.Present[SPC_Status] = true }
 
-	return nil
+	return
 }
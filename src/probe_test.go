@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"reflect"
+)
+
+func TestParseSchedule(t *testing.T) {
+	for s, want := range map[string]map[uint8]int{
+		"": {},
+		"cpu": {SPC_CPULoad:1},
+		"cpu:5,numa:0,custom:2": {SPC_CPULoad:5, SPC_NUMALoad:0, SPC_CustomMetrics:2},
+		"io:3,io:4": {SPC_IOLoad:4},
+	} {
+		sched, err := ParseSchedule(s)
+		if err != nil || !reflect.DeepEqual(sched, want) { t.Errorf("%q: got %v %v, want %v", s, sched, err, want) }
+	}
+
+	for _,s := range []string{"disk", "cpu:", "cpu:x", "cpu:-1", "cpu,", ":2"} {
+		if _,err := ParseSchedule(s); err == nil { t.Errorf("%q parsed", s) }
+	}
+}
+
+func TestScheduleMultiple(t *testing.T) {
+	m := LoadMessage{Schedule:map[uint8]int{SPC_NUMALoad:0, SPC_CPULoad:3}}
+	if m.multiple(SPC_NUMALoad) != 0 || m.multiple(SPC_CPULoad) != 3 || m.multiple(SPC_ProcLoad) != 1 {
+		t.Errorf("multiples %d %d %d", m.multiple(SPC_NUMALoad), m.multiple(SPC_CPULoad), m.multiple(SPC_ProcLoad))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"fmt"
+	"log"
+	"time"
+	"sync"
+	"bytes"
+	"strings"
+	"encoding/binary"
+)
+
+// relayed packets should fit in a datagram on common networks
+const RelayMaxSize = 1400
+
+// Relay forwards the messages received by a server to upstream servers,
+// several messages may be batched in a relay envelope
+type Relay struct {
+	lock sync.Mutex // the peer workers forward concurrently
+	peers []LoadPeer
+	keep map[uint8]bool // subpackets forwarded, all of them if nil
+	batch int
+	delay time.Duration
+	pending bytes.Buffer
+	count int
+	since time.Time
+}
+
+func NewRelay(upstream string, keys KeyRing, seals SealRing) (relay *Relay, err error) {
+	relay = &Relay{batch:*f_relay_batch, delay:time.Duration(*f_relay_delay) * time.Millisecond}
+	if relay.batch < 1 || relay.batch > 255 { return nil, fmt.Errorf("invalid relay batch: %d", relay.batch) }
+	if *f_relay_subpackets != "" {
+		if relay.keep,err = ParseSubpackets(*f_relay_subpackets); err != nil { return nil, err }
+	}
+	relay.peers,err = ParsePeers(upstream, keys, seals, true)
+	return
+}
+
+// ParseSubpackets takes comma separated probe or subpacket names
+func ParseSubpackets(s string) (codes map[uint8]bool, err error) {
+	codes = make(map[uint8]bool)
+names:
+	for _,name := range strings.Split(s, ",") {
+		for _,names := range []map[uint8]string{ProbeNames, InfoNames} {
+			for spcode,spname := range names {
+				if spname == name {
+					codes[spcode] = true
+					continue names
+				}
+			}
+		}
+		return nil, fmt.Errorf("unknown subpacket: %s", name)
+	}
+	return
+}
+
+// Forward queues the message received from ip
+func (relay *Relay) Forward(ip net.IP, msg []byte) {
+	var err error
+	if relay.keep != nil {
+		if msg,err = FilterSubpackets(msg, relay.keep); err != nil {
+			fmt.Println("Error filter relayed message:", err)
+			return
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil { ip = ip4 }
+
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	size := 1 + len(ip) + 2 + len(msg)
+	if relay.count > 0 && 2 + relay.pending.Len() + size > RelayMaxSize { relay.flush() }
+	if relay.count == 0 { relay.since = time.Now() }
+	relay.pending.WriteByte(uint8(len(ip)))
+	relay.pending.Write(ip)
+	binary.Write(&relay.pending, binary.BigEndian, uint16(len(msg)))
+	relay.pending.Write(msg)
+	relay.count ++
+
+	if relay.count >= relay.batch { relay.flush() }
+}
+
+// FlushDue sends the pending messages if they waited long enough
+func (relay *Relay) FlushDue() {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	if relay.count > 0 && time.Since(relay.since) >= relay.delay { relay.flush() }
+}
+
+func (relay *Relay) flush() {
+	if relay.count == 0 { return }
+	packet := append([]byte{ENV_RELAYED, uint8(relay.count)}, relay.pending.Bytes()...)
+	relay.pending.Reset()
+	relay.count = 0
+
+	for i := range relay.peers {
+		peer := &relay.peers[i]
+		buf,err := peer.Envelope(packet)
+		if err != nil {
+			log.Printf("peer %s: encrypt error: %v", peer.name, err)
+			continue
+		}
+		peer.Send(buf)
+	}
+}
+
+// Unrelay returns the messages of a relay envelope with the address of
+// their senders
+func Unrelay(packet []byte) (pkts []Packet, err error) {
+	if len(packet) < 2 || packet[0] != ENV_RELAYED { return nil, fmt.Errorf("not a relayed packet") }
+	count := int(packet[1])
+	buf := packet[2:]
+
+	for i := 0; i < count; i ++ {
+		if len(buf) < 1 { return nil, fmt.Errorf("premature relayed packet") }
+		iplen := int(buf[0])
+		if iplen != net.IPv4len && iplen != net.IPv6len { return nil, fmt.Errorf("invalid relayed address") }
+		if len(buf) < 1 + iplen + 2 { return nil, fmt.Errorf("premature relayed packet") }
+		ip := net.IP(append([]byte(nil), buf[1:1+iplen]...))
+		n := int(binary.BigEndian.Uint16(buf[1+iplen:]))
+		buf = buf[1+iplen+2:]
+		if len(buf) < n { return nil, fmt.Errorf("premature relayed packet") }
+		pkts = append(pkts, Packet{ip:ip, buf:buf[:n]})
+		buf = buf[n:]
+	}
+	return
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"time"
+	"bytes"
+	"testing"
+	"reflect"
+)
+
+func upstream(batch int) *Relay {
+	return &Relay{batch:batch, delay:time.Hour, peers:[]LoadPeer{{name:"upstream", proto:"tcp", queue:make(chan []byte, 8)}}}
+}
+
+func TestRelay(t *testing.T) {
+	relay := upstream(2)
+	relay.Forward(net.ParseIP("10.0.0.1"), []byte{4, 1})
+	if len(relay.peers[0].queue) != 0 { t.Fatalf("flushed before the batch is full") }
+	relay.Forward(net.ParseIP("fd00::1"), []byte{4, 2, 3})
+
+	pkts, err := Unrelay(<-relay.peers[0].queue)
+	if err != nil { t.Fatal(err) }
+	want := []Packet{{ip:net.ParseIP("10.0.0.1").To4(), buf:[]byte{4, 1}}, {ip:net.ParseIP("fd00::1"), buf:[]byte{4, 2, 3}}}
+	if !reflect.DeepEqual(pkts, want) { t.Errorf("got %v, want %v", pkts, want) }
+
+	// batches are cut to fit in a datagram
+	relay = upstream(255)
+	for i := 0; i < 3; i ++ { relay.Forward(net.ParseIP("10.0.0.1"), make([]byte, 600)) }
+	if len(relay.peers[0].queue) != 1 { t.Fatalf("%d packets sent", len(relay.peers[0].queue)) }
+	packet := <-relay.peers[0].queue
+	if len(packet) > RelayMaxSize || packet[1] != 2 { t.Errorf("packet of %d bytes, %d messages", len(packet), packet[1]) }
+
+	relay.FlushDue()
+	if len(relay.peers[0].queue) != 0 { t.Errorf("flushed before the delay") }
+	relay.delay = 0
+	relay.FlushDue()
+	if packet = <-relay.peers[0].queue; packet[1] != 1 { t.Errorf("%d messages flushed", packet[1]) }
+}
+
+func TestRelayFilter(t *testing.T) {
+	relay := upstream(1)
+	if relay.keep, _ = ParseSubpackets("identity,cpu"); len(relay.keep) != 2 { t.Fatalf("got %v", relay.keep) }
+
+	in := LoadMessage{Interval_ms:1000, Present:map[uint8]bool{SPC_Identity:true, SPC_CPULoad:true, SPC_Timing:true},
+		Identity:Identity{hostname:"web1"}, Cpu_load:CPULoad{Items:[]CPUItem{{Rate_idle:255}}}}
+	var w bytes.Buffer
+	in.Encode(&w)
+	relay.Forward(net.ParseIP("10.0.0.1"), w.Bytes())
+
+	pkts, err := Unrelay(<-relay.peers[0].queue)
+	if err != nil || len(pkts) != 1 { t.Fatalf("got %v %v", pkts, err) }
+	var out LoadMessage
+	if err = out.Decode(bytes.NewReader(pkts[0].buf)); err != nil { t.Fatal(err) }
+	if !reflect.DeepEqual(out.Present, map[uint8]bool{SPC_Identity:true, SPC_CPULoad:true}) || out.Identity.hostname != "web1" {
+		t.Errorf("got %v", out.Present)
+	}
+
+	// damaged messages are not forwarded
+	w.Bytes()[3] ^= 0xff
+	relay.Forward(net.ParseIP("10.0.0.1"), w.Bytes())
+	if len(relay.peers[0].queue) != 0 { t.Errorf("damaged message forwarded") }
+
+	if _,err = ParseSubpackets("cpu,disk"); err == nil { t.Errorf("unknown subpacket parsed") }
+}
+
+func TestFilterSubpackets(t *testing.T) {
+	body := rawMessage([]byte{SPC_Timing, 10, 0,0,0,1, 0,0,0,2, 0,3}, []byte{SPC_Status, 1, 0})
+	out, err := FilterSubpackets(body, map[uint8]bool{SPC_Status:true})
+	if err != nil { t.Fatal(err) }
+	if want := rawMessage([]byte{SPC_Status, 1, 0}); !bytes.Equal(out, want) { t.Errorf("got % x, want % x", out, want) }
+
+	for _,body := range [][]byte{
+		nil,
+		{0},
+		{4, 0, 0, 0, 0},
+		rawMessage([]byte{SPC_Timing, 10, 0}),
+		append(rawMessage(), 0),
+	} {
+		if _,err := FilterSubpackets(body, nil); err == nil { t.Errorf("% x filtered", body) }
+	}
+}
+
+func TestUnrelayMalformed(t *testing.T) {
+	for _,packet := range [][]byte{
+		nil,
+		{ENV_RELAYED},
+		{ENV_SIGNED, 0},
+		{ENV_RELAYED, 1},
+		{ENV_RELAYED, 1, 5, 1, 2, 3, 4, 5, 0, 0},
+		{ENV_RELAYED, 1, 4, 10, 0, 0},
+		{ENV_RELAYED, 1, 4, 10, 0, 0, 1, 0, 3, 4, 1},
+		{ENV_RELAYED, 2, 4, 10, 0, 0, 1, 0, 1, 4},
+	} {
+		if pkts, err := Unrelay(packet); err == nil { t.Errorf("% x unrelayed to %v", packet, pkts) }
+	}
+
+	if pkts, err := Unrelay([]byte{ENV_RELAYED, 0}); err != nil || len(pkts) != 0 { t.Errorf("empty envelope: got %v %v", pkts, err) }
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"errors"
+	"strings"
+	"strconv"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"./sutils"
+)
+
+// envelopes are told apart from plain messages, which start with their
+// version, by the first byte
+const (
+	// message followed by its HMAC-SHA256
+	ENV_SIGNED = 0xA5
+	// key id, nonce and the message sealed with AES-256-GCM
+	ENV_SEALED = 0xE1
+	// messages forwarded by a relay with the address of their senders
+	ENV_RELAYED = 0xB7
+)
+
+var ErrSignature = errors.New("bad signature")
+var ErrUnsigned = errors.New("unsigned message from a peer with a key")
+var ErrUnsealed = errors.New("unencrypted message from a peer with an encryption key")
+var ErrUnknownKey = errors.New("unknown encryption key id")
+
+// KeyRing maps peers, by address or hostname, to their shared key, "*"
+// gives the key of the peers not listed
+type KeyRing map[string][]byte
+
+// LoadKeys reads "peer hexkey" lines, empty lines and # comments are skipped
+func LoadKeys(filename string) (keys KeyRing, err error) {
+	file, err := os.Open(filename)
+	if err != nil { return }
+	defer file.Close()
+
+	keys = make(KeyRing)
+	err = sutils.ReadLines(file, func (line string) error {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") { return nil }
+		if len(fields) != 2 { return fmt.Errorf("invalid key line: %s", strings.TrimSpace(line)) }
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) < 16 { return fmt.Errorf("invalid key for %s", fields[0]) }
+		keys[fields[0]] = key
+		return nil
+	})
+	return
+}
+
+func (keys KeyRing) Key(names ...string) []byte {
+	for _,name := range names {
+		if key,ok := keys[name]; ok { return key }
+	}
+	return keys["*"]
+}
+
+func Sign(msg, key []byte) []byte {
+	packet := make([]byte, 0, 1 + len(msg) + sha256.Size)
+	packet = append(packet, ENV_SIGNED)
+	packet = append(packet, msg...)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(packet)
+	return mac.Sum(packet)
+}
+
+// Verify returns the message of a packet, which must be signed if key is
+// not nil
+func Verify(packet, key []byte) ([]byte, error) {
+	if len(packet) == 0 || packet[0] != ENV_SIGNED {
+		if key != nil { return nil, ErrUnsigned }
+		return packet, nil
+	}
+	if key == nil || len(packet) < 1 + sha256.Size { return nil, ErrSignature }
+
+	n := len(packet) - sha256.Size
+	mac := hmac.New(sha256.New, key)
+	mac.Write(packet[:n])
+	if !hmac.Equal(mac.Sum(nil), packet[n:]) { return nil, ErrSignature }
+	return packet[1:n], nil
+}
+
+// Fresh rejects replayed messages whose source timestamp is too far from
+// now, clock skew included
+func (m *LoadMessage) Fresh(window time.Duration) bool {
+	d := time.Since(m.Time())
+	return d < window && d > -window
+}
+
+// SealKeys are the encryption keys shared with a peer, by key id, new
+// messages are sealed with the current one
+type SealKeys struct {
+	current uint8
+	aeads map[uint8]cipher.AEAD
+}
+
+type SealRing map[string]*SealKeys
+
+// LoadSealKeys reads "peer keyid hexkey" lines with 32 bytes keys, the
+// last key listed for a peer is its current one, "*" stands for the
+// peers not listed
+func LoadSealKeys(filename string) (ring SealRing, err error) {
+	file, err := os.Open(filename)
+	if err != nil { return }
+	defer file.Close()
+
+	ring = make(SealRing)
+	err = sutils.ReadLines(file, func (line string) error {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") { return nil }
+		if len(fields) != 3 { return fmt.Errorf("invalid key line: %s", strings.TrimSpace(line)) }
+		id, err := strconv.ParseUint(fields[1], 0, 8)
+		if err != nil { return fmt.Errorf("invalid key id for %s", fields[0]) }
+		key, err := hex.DecodeString(fields[2])
+		if err != nil || len(key) != 32 { return fmt.Errorf("invalid key for %s, should be 32 bytes", fields[0]) }
+		block, err := aes.NewCipher(key)
+		if err != nil { return err }
+		aead, err := cipher.NewGCM(block)
+		if err != nil { return err }
+
+		if ring[fields[0]] == nil { ring[fields[0]] = &SealKeys{aeads:make(map[uint8]cipher.AEAD)} }
+		ring[fields[0]].aeads[uint8(id)] = aead
+		ring[fields[0]].current = uint8(id)
+		return nil
+	})
+	return
+}
+
+func (ring SealRing) Keys(names ...string) *SealKeys {
+	for _,name := range names {
+		if keys,ok := ring[name]; ok { return keys }
+	}
+	return ring["*"]
+}
+
+func Seal(msg []byte, keys *SealKeys) ([]byte, error) {
+	aead := keys.aeads[keys.current]
+	header := []byte{ENV_SEALED, keys.current}
+	nonce := make([]byte, aead.NonceSize())
+	if _,err := rand.Read(nonce); err != nil { return nil, err }
+
+	packet := append(header, nonce...)
+	return aead.Seal(packet, nonce, msg, header), nil
+}
+
+// Envelope seals, then signs msg as configured for the peer
+func (peer *LoadPeer) Envelope(msg []byte) (packet []byte, err error) {
+	packet = msg
+	if peer.seal != nil {
+		if packet,err = Seal(packet, peer.seal); err != nil { return nil, err }
+	}
+	if peer.key != nil { packet = Sign(packet, peer.key) }
+	return
+}
+
+// Open returns the message of a packet, which must be sealed if keys is
+// not nil
+func Open(packet []byte, keys *SealKeys) ([]byte, error) {
+	if len(packet) == 0 || packet[0] != ENV_SEALED {
+		if keys != nil { return nil, ErrUnsealed }
+		return packet, nil
+	}
+	if keys == nil || len(packet) < 2 { return nil, ErrUnknownKey }
+
+	aead := keys.aeads[packet[1]]
+	if aead == nil { return nil, ErrUnknownKey }
+	if len(packet) < 2 + aead.NonceSize() + aead.Overhead() { return nil, fmt.Errorf("premature sealed packet") }
+	nonce := packet[2:2 + aead.NonceSize()]
+	return aead.Open(nil, nonce, packet[2 + aead.NonceSize():], packet[:2])
+}
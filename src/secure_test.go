@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"time"
+	"bytes"
+	"testing"
+	"path/filepath"
+)
+
+func TestSignVerify(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	msg := []byte{4, 1, 2, 3}
+	packet := Sign(msg, key)
+
+	if out, err := Verify(packet, key); err != nil || !bytes.Equal(out, msg) { t.Errorf("got % x %v", out, err) }
+	if _,err := Verify(packet, []byte("fedcba9876543210")); err != ErrSignature { t.Errorf("other key: got %v", err) }
+	if _,err := Verify(packet, nil); err != ErrSignature { t.Errorf("no key: got %v", err) }
+	if _,err := Verify(msg, key); err != ErrUnsigned { t.Errorf("unsigned: got %v", err) }
+	if out, err := Verify(msg, nil); err != nil || !bytes.Equal(out, msg) { t.Errorf("unsigned without a key: got % x %v", out, err) }
+	if _,err := Verify(nil, key); err != ErrUnsigned { t.Errorf("empty: got %v", err) }
+
+	// the first byte is checked by the unsigned cases
+	for i := 1; i < len(packet); i ++ {
+		damaged := append([]byte(nil), packet...)
+		damaged[i] ^= 0x01
+		if _,err := Verify(damaged, key); err != ErrSignature { t.Errorf("damaged at %d: got %v", i, err) }
+	}
+	for n := 1; n < len(packet); n ++ {
+		if _,err := Verify(packet[:n], key); err != ErrSignature { t.Errorf("cut at %d: got %v", n, err) }
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(filename, []byte("# peers\n10.0.0.1 000102030405060708090a0b0c0d0e0f\n\n* 0f0e0d0c0b0a09080706050403020100ff\n"), 0644)
+
+	keys, err := LoadKeys(filename)
+	if err != nil { t.Fatal(err) }
+	if key := keys.Key("web1", "10.0.0.1"); len(key) != 16 || key[1] != 1 { t.Errorf("got % x", key) }
+	if key := keys.Key("10.0.0.2"); len(key) != 17 || key[0] != 0x0f { t.Errorf("default key: got % x", key) }
+
+	for _,content := range []string{"10.0.0.1\n", "10.0.0.1 0001\n", "10.0.0.1 zz0102030405060708090a0b0c0d0e0f\n", "a b c\n"} {
+		os.WriteFile(filename, []byte(content), 0644)
+		if _,err := LoadKeys(filename); err == nil { t.Errorf("%q loaded", content) }
+	}
+}
+
+func TestFresh(t *testing.T) {
+	now := time.Now()
+	for _,c := range []struct{ d time.Duration; want bool }{
+		{0, true},
+		{-50 * time.Second, true},
+		{50 * time.Second, true},
+		{-2 * time.Minute, false},
+		{2 * time.Minute, false},
+	} {
+		ts := now.Add(c.d)
+		m := LoadMessage{Timestamp:ToTimestamp(ts), Timestamp_ms:uint16(ts.Nanosecond() / 1e6)}
+		if got := m.Fresh(time.Minute); got != c.want { t.Errorf("%v: got %v", c.d, got) }
+	}
+}
+
+func sealKeys(t *testing.T, content string) SealRing {
+	filename := filepath.Join(t.TempDir(), "seals")
+	os.WriteFile(filename, []byte(content), 0644)
+	ring, err := LoadSealKeys(filename)
+	if err != nil { t.Fatal(err) }
+	return ring
+}
+
+const sealKey1 = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+const sealKey2 = "ff0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func TestSealOpen(t *testing.T) {
+	ring := sealKeys(t, "10.0.0.1 1 " + sealKey1 + "\n10.0.0.1 2 " + sealKey2 + "\n* 1 " + sealKey2 + "\n")
+	keys := ring.Keys("10.0.0.1")
+	if keys == nil || keys.current != 2 || len(keys.aeads) != 2 { t.Fatalf("got %v", keys) }
+	if ring.Keys("10.0.0.2") != ring["*"] { t.Errorf("no default keys") }
+
+	msg := []byte{4, 1, 2, 3}
+	packet, err := Seal(msg, keys)
+	if err != nil { t.Fatal(err) }
+	if packet[0] != ENV_SEALED || packet[1] != 2 { t.Errorf("header % x", packet[:2]) }
+	if out, err := Open(packet, keys); err != nil || !bytes.Equal(out, msg) { t.Errorf("got % x %v", out, err) }
+	if again,_ := Seal(msg, keys); bytes.Equal(again, packet) { t.Errorf("nonce reused") }
+
+	// messages sealed with a previous key are still opened
+	old := &SealKeys{current:1, aeads:keys.aeads}
+	packet1,_ := Seal(msg, old)
+	if out, err := Open(packet1, keys); err != nil || !bytes.Equal(out, msg) { t.Errorf("previous key: got % x %v", out, err) }
+
+	if _,err := Open(packet, ring["*"]); err != ErrUnknownKey { t.Errorf("unknown key id: got %v", err) }
+	if _,err := Open(packet, nil); err != ErrUnknownKey { t.Errorf("no keys: got %v", err) }
+	if _,err := Open(msg, keys); err != ErrUnsealed { t.Errorf("unsealed: got %v", err) }
+	if out, err := Open(msg, nil); err != nil || !bytes.Equal(out, msg) { t.Errorf("unsealed without keys: got % x %v", out, err) }
+
+	for i := 2; i < len(packet); i ++ {
+		damaged := append([]byte(nil), packet...)
+		damaged[i] ^= 0x01
+		if _,err := Open(damaged, keys); err == nil { t.Errorf("damaged at %d opened", i) }
+	}
+	for n := 1; n < len(packet); n ++ {
+		if _,err := Open(packet[:n], keys); err == nil { t.Errorf("cut at %d opened", n) }
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	ring := sealKeys(t, "* 7 " + sealKey1 + "\n")
+	peer := LoadPeer{key:[]byte("0123456789abcdef"), seal:ring["*"]}
+	msg := []byte{4, 1, 2, 3}
+
+	packet, err := peer.Envelope(msg)
+	if err != nil || packet[0] != ENV_SIGNED { t.Fatalf("got % x %v", packet, err) }
+	sealed, err := Verify(packet, peer.key)
+	if err != nil { t.Fatal(err) }
+	if out, err := Open(sealed, peer.seal); err != nil || !bytes.Equal(out, msg) { t.Errorf("got % x %v", out, err) }
+}
+
+func TestLoadSealKeys(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "seals")
+	for _,content := range []string{"* " + sealKey1 + "\n", "* 256 " + sealKey1 + "\n", "* x " + sealKey1 + "\n", "* 1 0001\n"} {
+		os.WriteFile(filename, []byte(content), 0644)
+		if _,err := LoadSealKeys(filename); err == nil { t.Errorf("%q loaded", content) }
+	}
+}
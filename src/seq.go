@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"fmt"
+	"sort"
+)
+
+// sequence numbers further than this behind the newest one are no longer
+// waited for, they are lost
+const SeqWindow = 1024
+
+// boot ids remembered before the previous one, their packets are
+// dropped as stale
+const SeqOldBoots = 4
+
+// BootWindow is what is known of the sequence numbers of one boot of a peer
+type BootWindow struct {
+	boot_id uint64
+	newest uint32
+	missing map[uint32]bool
+}
+
+// LossStats tracks the sequence numbers received from a peer. The window
+// of the previous boot is kept, late or spooled packets sent before a
+// restart are still counted and de-duplicated in it, and packets of the
+// boots before are dropped.
+type LossStats struct {
+	current, previous BootWindow
+	old []uint64 // boot ids before the previous one
+	received, lost, duplicates, reordered, stale uint64
+	restarts int
+}
+
+const (
+	SEQ_OK = iota
+	SEQ_GAP
+	SEQ_DUPLICATE
+	SEQ_REORDERED
+	SEQ_RESTART
+	SEQ_STALE
+)
+
+func (st *LossStats) Track(boot_id uint64, seq uint32) int {
+	if st.current.missing != nil && boot_id != st.current.boot_id {
+		if st.previous.missing != nil && boot_id == st.previous.boot_id { return st.track(&st.previous, seq) }
+		for _,old := range st.old {
+			if old == boot_id {
+				st.stale ++
+				return SEQ_STALE
+			}
+		}
+	}
+
+	if st.current.missing == nil || boot_id != st.current.boot_id {
+		restarted := st.current.missing != nil
+		if st.previous.missing != nil {
+			st.old = append(st.old, st.previous.boot_id)
+			if len(st.old) > SeqOldBoots { st.old = st.old[1:] }
+		}
+		st.previous = st.current
+		st.current = BootWindow{boot_id:boot_id, newest:seq, missing:make(map[uint32]bool)}
+		st.received ++
+		if restarted {
+			st.restarts ++
+			return SEQ_RESTART
+		}
+		return SEQ_OK
+	}
+
+	return st.track(&st.current, seq)
+}
+
+func (st *LossStats) track(win *BootWindow, seq uint32) int {
+	switch {
+	case seq == win.newest + 1:
+		win.newest = seq
+	case int32(seq - win.newest) > 0:
+		start := win.newest + 1
+		if seq - start > SeqWindow { start = seq - SeqWindow }
+		for s := start; s != seq; s ++ { win.missing[s] = true }
+		st.lost += uint64(seq - win.newest - 1)
+		win.newest = seq
+		for s := range win.missing {
+			if win.newest - s > SeqWindow { delete(win.missing, s) }
+		}
+		st.received ++
+		return SEQ_GAP
+	case win.missing[seq]:
+		delete(win.missing, seq)
+		st.lost --
+		st.reordered ++
+		st.received ++
+		return SEQ_REORDERED
+	default:
+		st.duplicates ++
+		return SEQ_DUPLICATE
+	}
+
+	st.received ++
+	return SEQ_OK
+}
+
+func DumpLossStats(w io.Writer, stats map[string]*LossStats) {
+	keys := make([]string, 0, len(stats))
+	for key := range stats { keys = append(keys, key) }
+	sort.Strings(keys)
+
+	for _,key := range keys {
+		st := stats[key]
+		fmt.Fprintf(w, "peer %s: received %d, lost %d, duplicates %d, reordered %d, restarts %d, stale %d\n",
+			key, st.received, st.lost, st.duplicates, st.reordered, st.restarts, st.stale)
+	}
+}
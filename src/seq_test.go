@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLossStatsTrack(t *testing.T) {
+	var st LossStats
+	for i,c := range []struct{ boot_id uint64; seq uint32; want int }{
+		{1, 10, SEQ_OK},
+		{1, 11, SEQ_OK},
+		{1, 14, SEQ_GAP},
+		{1, 12, SEQ_REORDERED},
+		{1, 12, SEQ_DUPLICATE},
+		{1, 13, SEQ_REORDERED},
+		{1, 5, SEQ_DUPLICATE},
+		{2, 1, SEQ_RESTART},
+		// late packets of the previous boot
+		{1, 15, SEQ_OK},
+		{1, 14, SEQ_DUPLICATE},
+		{2, 2, SEQ_OK},
+		{3, 1, SEQ_RESTART},
+		{1, 16, SEQ_STALE},
+		{2, 3, SEQ_OK},
+	} {
+		if got := st.Track(c.boot_id, c.seq); got != c.want { t.Errorf("%d: boot %d seq %d: got %d, want %d", i, c.boot_id, c.seq, got, c.want) }
+	}
+
+	if st.received != 10 || st.lost != 0 || st.duplicates != 3 || st.reordered != 2 || st.restarts != 2 || st.stale != 1 {
+		t.Errorf("received %d, lost %d, duplicates %d, reordered %d, restarts %d, stale %d",
+			st.received, st.lost, st.duplicates, st.reordered, st.restarts, st.stale)
+	}
+
+	var w bytes.Buffer
+	DumpLossStats(&w, map[string]*LossStats{"web1":&st})
+	want := "peer web1: received 10, lost 0, duplicates 3, reordered 2, restarts 2, stale 1\n"
+	if w.String() != want { t.Errorf("got %q, want %q", w.String(), want) }
+}
+
+func TestLossStatsWindow(t *testing.T) {
+	var st LossStats
+	st.Track(1, 0)
+	if got := st.Track(1, 5000); got != SEQ_GAP || st.lost != 4999 { t.Fatalf("got %d, lost %d", got, st.lost) }
+	if len(st.current.missing) > SeqWindow { t.Errorf("%d missing sequence numbers kept", len(st.current.missing)) }
+
+	// forgotten ones are not waited for anymore
+	if got := st.Track(1, 10); got != SEQ_DUPLICATE { t.Errorf("got %d for a forgotten sequence number", got) }
+	if got := st.Track(1, 4990); got != SEQ_REORDERED || st.lost != 4998 { t.Errorf("got %d, lost %d", got, st.lost) }
+
+	// the sequence number wraps around
+	st.Track(2, 0xfffffffe)
+	if got := st.Track(2, 1); got != SEQ_GAP || st.lost != 5000 { t.Errorf("got %d, lost %d after a wrap", got, st.lost) }
+}
+
+func TestLossStatsOldBoots(t *testing.T) {
+	var st LossStats
+	for boot := uint64(1); boot <= SeqOldBoots + 3; boot ++ { st.Track(boot, 1) }
+	if len(st.old) != SeqOldBoots { t.Errorf("%d old boots kept", len(st.old)) }
+
+	if got := st.Track(3, 2); got != SEQ_STALE { t.Errorf("got %d for an old boot", got) }
+	if got := st.Track(1, 2); got != SEQ_RESTART { t.Errorf("got %d for a forgotten boot", got) }
+}
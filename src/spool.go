@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"time"
+)
+
+// Backlog keeps the messages to a stream peer until the peer acks them,
+// they are written again when the peer reconnects
+type Backlog interface {
+	// Append returns the number of unacked messages dropped to make room
+	Append(packet []byte) (dropped int, err error)
+	// Ack forgets the n oldest unacked messages
+	Ack(n int)
+	Pending() int
+	// Replay writes the unacked messages in order
+	Replay(w func(packet []byte) error) (n int, err error)
+}
+
+// MemoryBacklog is the backlog of the stream peers without spool, the
+// oldest messages are dropped beyond max
+type MemoryBacklog struct {
+	max int
+	packets [][]byte
+}
+
+func (b *MemoryBacklog) Append(packet []byte) (dropped int, err error) {
+	b.packets = append(b.packets, packet)
+	if len(b.packets) > b.max {
+		dropped = len(b.packets) - b.max
+		b.packets = b.packets[dropped:]
+	}
+	return
+}
+
+func (b *MemoryBacklog) Ack(n int) {
+	if n > len(b.packets) { n = len(b.packets) }
+	b.packets = b.packets[n:]
+}
+
+func (b *MemoryBacklog) Pending() int {
+	return len(b.packets)
+}
+
+func (b *MemoryBacklog) Replay(w func(packet []byte) error) (n int, err error) {
+	for _,packet := range b.packets {
+		if err = w(packet); err != nil { return }
+		n ++
+	}
+	return
+}
+
+// Spool keeps on disk the messages to a stream peer until they are acked,
+// in the log file format, bounded by size and age. When it is full, or its
+// oldest records expired, it is rewritten without the expired records and
+// with room for a quarter of its size, dropping the oldest ones.
+type Spool struct {
+	filename string
+	logfile *LogFile
+	size, maxsize int64
+	maxage time.Duration
+	count int // records in the file
+	acked int // records at the head of the file acked by the peer
+	first uint32 // time the first record was spooled
+}
+
+// OpenSpool takes the records left by a previous run, the damaged and
+// expired ones are dropped
+func OpenSpool(filename string, maxsize int64, maxage time.Duration) (spool *Spool, err error) {
+	spool = &Spool{filename:filename, maxsize:maxsize, maxage:maxage}
+	if _,err = spool.compact(maxsize); err != nil { return nil, err }
+	return
+}
+
+func (spool *Spool) Len() int64 {
+	return spool.size
+}
+
+func (spool *Spool) Append(packet []byte) (dropped int, err error) {
+	size := int64(len(packet) + 10)
+	if size > spool.maxsize { return 0, fmt.Errorf("message larger than spool %s, dropped", spool.filename) }
+
+	// expired records are let pass an eighth of the age before rewriting
+	expired := ToTimestamp(time.Now().Add(-spool.maxage - spool.maxage / 8))
+	if spool.size + size > spool.maxsize || (spool.count > 0 && spool.first < expired) {
+		if dropped,err = spool.compact(spool.maxsize * 3 / 4 - size); err != nil { return }
+	}
+
+	if spool.logfile == nil { return dropped, fmt.Errorf("spool %s not open, message dropped", spool.filename) }
+	if err = spool.logfile.WriteMessage(packet); err != nil { return }
+	if spool.count == 0 { spool.first = GetTimestamp() }
+	spool.size += size
+	spool.count ++
+	return
+}
+
+// Ack empties the spool once all of its records are acked
+func (spool *Spool) Ack(n int) {
+	spool.acked += n
+	if spool.acked < spool.count { return }
+
+	if err := os.Truncate(spool.filename, 0); err != nil {
+		fmt.Println("Warning: failed truncate spool:", err)
+		return
+	}
+	spool.size, spool.count, spool.acked = 0, 0, 0
+}
+
+func (spool *Spool) Pending() int {
+	return spool.count - spool.acked
+}
+
+// Replay writes the unacked records in order, those older than maxage are
+// dropped first
+func (spool *Spool) Replay(w func(packet []byte) error) (n int, err error) {
+	if _,err = spool.compact(spool.maxsize); err != nil || spool.count == 0 { return }
+
+	logfile,err := OpenLogFile(spool.filename, MODE_READ)
+	if err != nil { return }
+	defer logfile.Close()
+
+	for {
+		_,packet,rerr := logfile.ReadMessage()
+		if rerr == io.EOF { break }
+		if _,ok := rerr.(*CorruptRecordError); ok { continue }
+		if rerr != nil { return n, rerr }
+		if err = w(packet); err != nil { return }
+		n ++
+	}
+	return
+}
+
+// compact rewrites the spool without its acked, damaged and expired
+// records, and without its oldest records beyond target bytes, keeping the
+// time they were spooled. It returns the number of unacked records
+// dropped.
+func (spool *Spool) compact(target int64) (dropped int, err error) {
+	if spool.logfile != nil {
+		spool.logfile.Close()
+		spool.logfile = nil
+	}
+	oldest := ToTimestamp(time.Now().Add(-spool.maxage))
+
+	// each pass takes the records kept, and calls keep for them
+	scan := func(keep func(ts uint32, packet []byte) error) error {
+		logfile,err := OpenLogFile(spool.filename, MODE_READ)
+		if os.IsNotExist(err) { return nil }
+		if err != nil { return err }
+		defer logfile.Close()
+
+		for i := 0; ; {
+			ts,packet,rerr := logfile.ReadMessage()
+			if rerr == io.EOF { return nil }
+			if _,ok := rerr.(*CorruptRecordError); ok { continue }
+			if rerr != nil { return rerr }
+			if i ++; i <= spool.acked { continue }
+			if ts < oldest {
+				dropped ++
+				continue
+			}
+			if err = keep(ts, packet); err != nil { return err }
+		}
+	}
+
+	var total int64
+	err = scan(func(ts uint32, packet []byte) error {
+		total += int64(len(packet) + 10)
+		return nil
+	})
+	if err != nil { return 0, spool.reopen(err) }
+
+	tmpname := spool.filename + ".tmp"
+	tmp,err := os.OpenFile(tmpname, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil { return 0, spool.reopen(err) }
+
+	var size int64
+	var count int
+	var first uint32
+	dropped = 0
+	err = scan(func(ts uint32, packet []byte) error {
+		if total > target {
+			total -= int64(len(packet) + 10)
+			dropped ++
+			return nil
+		}
+		if count == 0 { first = ts }
+		size += int64(len(packet) + 10)
+		count ++
+		return WriteRecord(tmp, ts, packet)
+	})
+	if cerr := tmp.Close(); err == nil { err = cerr }
+	if err == nil { err = os.Rename(tmpname, spool.filename) }
+	if err != nil {
+		os.Remove(tmpname)
+		return 0, spool.reopen(err)
+	}
+
+	spool.size, spool.count, spool.acked, spool.first = size, count, 0, first
+	spool.logfile,err = OpenLogFile(spool.filename, MODE_APPEND)
+	return
+}
+
+// reopen leaves the spool as it was after a failed compaction
+func (spool *Spool) reopen(err error) error {
+	if logfile,oerr := OpenLogFile(spool.filename, MODE_APPEND); oerr == nil { spool.logfile = logfile }
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"time"
+	"bytes"
+	"testing"
+	"path/filepath"
+)
+
+// replayed returns the second bytes of the messages replayed by b
+func replayed(t *testing.T, b Backlog) (seqs []byte) {
+	_,err := b.Replay(func(packet []byte) error {
+		seqs = append(seqs, packet[1])
+		return nil
+	})
+	if err != nil { t.Fatal(err) }
+	return
+}
+
+func TestMemoryBacklog(t *testing.T) {
+	b := &MemoryBacklog{max:3}
+	for i := byte(1); i <= 4; i ++ {
+		dropped,_ := b.Append([]byte{4, i})
+		want := 0
+		if i == 4 { want = 1 }
+		if dropped != want { t.Errorf("message %d: %d dropped", i, dropped) }
+	}
+	if seqs := replayed(t, b); !bytes.Equal(seqs, []byte{2, 3, 4}) { t.Errorf("replayed %v", seqs) }
+
+	b.Ack(2)
+	if b.Pending() != 1 { t.Errorf("%d pending", b.Pending()) }
+	b.Ack(5)
+	if b.Pending() != 0 { t.Errorf("%d pending", b.Pending()) }
+}
+
+func TestSpool(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "peer.spool")
+	spool, err := OpenSpool(filename, 1 << 20, time.Hour)
+	if err != nil { t.Fatal(err) }
+
+	for i := byte(1); i <= 3; i ++ {
+		if dropped,err := spool.Append([]byte{4, i}); dropped != 0 || err != nil { t.Fatalf("got %d %v", dropped, err) }
+	}
+	if spool.Pending() != 3 || spool.Len() != 3 * 12 { t.Errorf("%d pending, %d bytes", spool.Pending(), spool.Len()) }
+
+	spool.Ack(1)
+	if seqs := replayed(t, spool); !bytes.Equal(seqs, []byte{2, 3}) { t.Errorf("replayed %v", seqs) }
+
+	// the records are kept by a restart
+	spool.logfile.Close()
+	spool, err = OpenSpool(filename, 1 << 20, time.Hour)
+	if err != nil { t.Fatal(err) }
+	spool.Append([]byte{4, 4})
+	if seqs := replayed(t, spool); !bytes.Equal(seqs, []byte{2, 3, 4}) { t.Errorf("replayed %v after reopen", seqs) }
+
+	spool.Ack(3)
+	if st,_ := os.Stat(filename); spool.Pending() != 0 || spool.Len() != 0 || st.Size() != 0 { t.Errorf("spool not emptied") }
+	spool.Append([]byte{4, 5})
+	if seqs := replayed(t, spool); !bytes.Equal(seqs, []byte{5}) { t.Errorf("replayed %v after ack", seqs) }
+
+	if _,err = spool.Append(make([]byte, 2 << 20)); err == nil { t.Errorf("message larger than the spool appended") }
+}
+
+func TestSpoolFull(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "peer.spool")
+	spool, err := OpenSpool(filename, 1100, time.Hour)
+	if err != nil { t.Fatal(err) }
+
+	packet := make([]byte, 100)
+	for i := byte(1); i <= 10; i ++ {
+		packet[1] = i
+		if dropped,_ := spool.Append(packet); dropped != 0 { t.Fatalf("message %d: %d dropped", i, dropped) }
+	}
+
+	// the oldest records are dropped to leave a quarter of the spool free
+	packet[1] = 11
+	if dropped,err := spool.Append(packet); dropped != 4 || err != nil { t.Errorf("got %d %v", dropped, err) }
+	if seqs := replayed(t, spool); !bytes.Equal(seqs, []byte{5, 6, 7, 8, 9, 10, 11}) { t.Errorf("replayed %v", seqs) }
+	if spool.Len() > 1100 * 3 / 4 + 110 { t.Errorf("%d bytes after eviction", spool.Len()) }
+}
+
+func TestSpoolExpired(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "peer.spool")
+	file, _ := os.Create(filename)
+	old := ToTimestamp(time.Now().Add(-2 * time.Hour))
+	WriteRecord(file, old, []byte{4, 1})
+	WriteRecord(file, old, []byte{4, 2})
+	file.Write([]byte{0, 0, 0, 1, 0x80, 2, 4}) // damaged
+	recent := ToTimestamp(time.Now().Add(-time.Minute))
+	WriteRecord(file, recent, []byte{4, 3})
+	file.Close()
+
+	spool, err := OpenSpool(filename, 1 << 20, time.Hour)
+	if err != nil { t.Fatal(err) }
+	if seqs := replayed(t, spool); !bytes.Equal(seqs, []byte{3}) { t.Errorf("replayed %v", seqs) }
+
+	// records are spooled with their original time
+	logfile, _ := OpenLogFile(filename, MODE_READ)
+	defer logfile.Close()
+	if ts,_,err := logfile.ReadMessage(); err != nil || ts != recent { t.Errorf("got %d %v", ts, err) }
+}
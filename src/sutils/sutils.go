@@ -15,6 +15,10 @@ func ReadLines(r io.Reader, f func(line string) (err error)) (err error) {
 		if err != nil { return err }
 		line, err = reader.ReadString('\n')
 	}
-	if err == io.EOF { err = nil }
+	if err == io.EOF {
+		// last line without the newline
+		err = nil
+		if line != "" { err = f(line) }
+	}
 	return
 }
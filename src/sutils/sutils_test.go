@@ -0,0 +1,29 @@
+package sutils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"reflect"
+)
+
+func TestReadLines(t *testing.T) {
+	for in, want := range map[string][]string{
+		"": nil,
+		"a\nb\n": {"a\n", "b\n"},
+		"a\nb": {"a\n", "b"},
+		"\n": {"\n"},
+	} {
+		var lines []string
+		err := ReadLines(strings.NewReader(in), func (line string) error {
+			lines = append(lines, line)
+			return nil
+		})
+		if err != nil || !reflect.DeepEqual(lines, want) { t.Errorf("%q: got %q %v, want %q", in, lines, err, want) }
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err := ReadLines(strings.NewReader("a\nb\nc"), func (line string) error { n ++; return stop })
+	if err != stop || n != 1 { t.Errorf("got %v after %d lines", err, n) }
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"io"
+	"os"
+	"net"
+	"fmt"
+	"log"
+	"time"
+	"bufio"
+	"errors"
+	"syscall"
+	"sync/atomic"
+	"strings"
+	"strconv"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"encoding/binary"
+	"./sutils"
+)
+
+const (
+	// messages waiting for a stream peer to (re)connect, or to ack them
+	// without spool
+	StreamQueueSize = 64
+	StreamMaxBackoff = time.Minute
+	StreamDialTimeout = 10 * time.Second
+	StreamWriteTimeout = 10 * time.Second
+	// the connection is dropped when a written message is not acked
+	StreamAckTimeout = 30 * time.Second
+	// servers close the connections without any message for this long
+	StreamIdleTimeout = 15 * time.Minute
+)
+
+// Packet is a datagram or a record received from a stream
+type Packet struct {
+	ip net.IP
+	buf []byte
+	stream bool // may have been spooled by the sender
+	done chan<- bool // stream records, told whether the record was delivered
+}
+
+func TLSConfig() (conf *tls.Config, err error) {
+	conf = &tls.Config{MinVersion:tls.VersionTLS12}
+
+	if *f_tls_cert != "" {
+		cert, err := tls.LoadX509KeyPair(*f_tls_cert, *f_tls_key)
+		if err != nil { return nil, err }
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	// verifies the server on the sender, and requires client certificates
+	// on the receiver
+	if *f_tls_ca != "" {
+		pem, err := ioutil.ReadFile(*f_tls_ca)
+		if err != nil { return nil, err }
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) { return nil, errors.New("no certificate in " + *f_tls_ca) }
+		conf.RootCAs = pool
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return
+}
+
+// SplitPeer splits a [udp|tcp|tls://]host[:port] peer, the host may be a
+// bracketed IPv6 address
+func SplitPeer(s string, port int) (proto, host, hostport string, err error) {
+	proto = "udp"
+	if i := strings.Index(s, "://"); i >= 0 { proto, s = s[:i], s[i+3:] }
+	if proto != "udp" && proto != "tcp" && proto != "tls" {
+		return "", "", "", fmt.Errorf("invalid peer protocol: %s", proto)
+	}
+
+	host, sport, err := net.SplitHostPort(s)
+	if err != nil {
+		// no port, the brackets of an IPv6 address are optional then
+		host = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+		sport = strconv.Itoa(port)
+	}
+	if host == "" { return "", "", "", fmt.Errorf("invalid peer address: %s", s) }
+	return proto, host, net.JoinHostPort(host, sport), nil
+}
+
+// ParsePeers sets up the comma separated peers, the tcp and tls ones are
+// streamed to only if stream is true
+func ParsePeers(list string, keys KeyRing, seals SealRing, stream bool) (peers []LoadPeer, err error) {
+	var tlsconf *tls.Config
+	if list == "" { return }
+
+	s := strings.Split(list, ",")
+	peers = make([]LoadPeer, len(s))
+	for i,ss := range s {
+		peer := &peers[i]
+		peer.proto, peer.name, peer.hostport, err = SplitPeer(ss, *f_port)
+		if err != nil { return nil, err }
+		if err = peer.Resolve(); err != nil { return nil, fmt.Errorf("invalid peer address: %v", err) }
+		peer.key = keys.Key(peer.name, peer.addr.IP.String())
+		peer.seal = seals.Keys(peer.name, peer.addr.IP.String())
+		if peer.proto != "udp" && stream {
+			if tlsconf == nil && peer.proto == "tls" {
+				tlsconf,err = TLSConfig()
+				if err != nil { return nil, fmt.Errorf("invalid tls config: %v", err) }
+			}
+			peer.queue = make(chan []byte, StreamQueueSize)
+			if *f_spool_dir != "" {
+				filename := fmt.Sprintf("%s/%s-%d.spool", *f_spool_dir, peer.name, peer.addr.Port)
+				peer.spool,err = OpenSpool(filename, int64(*f_spool_size) << 20, time.Duration(*f_spool_age) * time.Minute)
+				if err != nil { return nil, fmt.Errorf("failed open spool: %v", err) }
+			}
+			go peer.Stream(tlsconf)
+		}
+		if *f_resolve > 0 && net.ParseIP(peer.name) == nil {
+			go peer.Reresolve(time.Duration(*f_resolve) * time.Minute)
+		}
+	}
+	return
+}
+
+func (peer *LoadPeer) Addr() *net.UDPAddr {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	return peer.addr
+}
+
+// Resolve looks up the address of the peer, udp peers are reconnected when
+// it changed
+func (peer *LoadPeer) Resolve() error {
+	addr, err := net.ResolveUDPAddr("udp", peer.hostport)
+	if err != nil { return err }
+	if addr.IP.IsLinkLocalMulticast() && addr.Zone == "" { addr.Zone = *f_mcast_if }
+
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	if peer.addr != nil && addr.IP.Equal(peer.addr.IP) { return nil }
+	if peer.addr != nil { log.Printf("peer %s: address changed from %s to %s", peer.name, peer.addr.IP, addr.IP) }
+	if peer.proto == "udp" {
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil { return err }
+		if addr.IP.IsMulticast() {
+			if err = SetMulticast(conn, addr.IP); err != nil {
+				conn.Close()
+				return err
+			}
+		}
+		if peer.conn != nil { peer.conn.Close() }
+		peer.conn = conn
+	}
+	peer.addr = addr
+	return nil
+}
+
+// Reresolve follows the address changes of a peer given by hostname
+func (peer *LoadPeer) Reresolve(every time.Duration) {
+	for range time.Tick(every) {
+		if err := peer.Resolve(); err != nil { log.Printf("peer %s: resolve failed: %v", peer.name, err) }
+	}
+}
+
+func (peer *LoadPeer) Send(packet []byte) {
+	if peer.proto == "udp" {
+		peer.lock.Lock()
+		peer.conn.Write(packet)
+		peer.lock.Unlock()
+		return
+	}
+
+	select {
+	case peer.queue <- packet:
+	default:
+		fmt.Printf("Warning: peer %s unreachable, message dropped\n", peer.name)
+	}
+}
+
+func (peer *LoadPeer) dial(conf *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout:StreamDialTimeout}
+	if peer.proto == "tls" {
+		conf = conf.Clone()
+		conf.ServerName = peer.name
+		return tls.DialWithDialer(dialer, "tcp", peer.Addr().String(), conf)
+	}
+	return dialer.Dial("tcp", peer.Addr().String())
+}
+
+// Stream writes the queued messages to a tcp or tls peer, reconnecting
+// with an exponential backoff. Messages are kept in the spool if there is
+// one, in memory otherwise, until the peer acks them, and written again
+// on reconnection.
+func (peer *LoadPeer) Stream(conf *tls.Config) {
+	var conn net.Conn
+	var err error
+	var acks chan struct{} // the server acked messages on conn
+	var acked *uint32 // messages acked on conn, see readAcks
+	var taken uint32 // acks of conn already passed to the backlog
+	var ignore int // acks to come for messages dropped from the backlog
+	var timeout <-chan time.Time // waiting for an ack
+	backoff := time.Second
+	retry := time.After(0)
+
+	var backlog Backlog = &MemoryBacklog{max:StreamQueueSize}
+	if peer.spool != nil { backlog = peer.spool }
+
+	write := func(packet []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(StreamWriteTimeout))
+		if err := WriteRecord(conn, GetTimestamp(), packet); err != nil { return err }
+		if timeout == nil { timeout = time.After(StreamAckTimeout) }
+		return nil
+	}
+	disconnect := func(err error) {
+		log.Printf("peer %s: %v, reconnect in %v", peer.name, err, backoff)
+		conn.Close()
+		conn, acks, timeout, ignore = nil, nil, nil, 0
+		retry = time.After(backoff)
+	}
+
+	for {
+		select {
+		case packet := <-peer.queue:
+			dropped, err := backlog.Append(packet)
+			if dropped > 0 { fmt.Printf("Warning: peer %s unreachable, %d old messages dropped\n", peer.name, dropped) }
+			if err != nil {
+				fmt.Println("Warning:", err)
+				continue
+			}
+			if conn == nil { continue }
+			// the unacked messages were all written to conn
+			ignore += dropped
+			if err = write(packet); err != nil { disconnect(fmt.Errorf("write failed: %v", err)) }
+
+		case _,ok := <-acks:
+			if !ok {
+				disconnect(errors.New("connection closed by the server"))
+				continue
+			}
+			n := atomic.LoadUint32(acked)
+			k := int(n - taken)
+			taken = n
+			if k <= ignore {
+				ignore -= k
+				continue
+			}
+			backlog.Ack(k - ignore)
+			ignore = 0
+			timeout = nil
+			if backlog.Pending() > 0 { timeout = time.After(StreamAckTimeout) }
+
+		case <-timeout:
+			disconnect(errors.New("messages not acked"))
+
+		case <-retry:
+			conn, err = peer.dial(conf)
+			if err != nil {
+				conn = nil
+				log.Printf("peer %s: connect failed, retry in %v: %v", peer.name, backoff, err)
+				retry = time.After(backoff)
+				if backoff *= 2; backoff > StreamMaxBackoff { backoff = StreamMaxBackoff }
+				continue
+			}
+			log.Printf("peer %s: connected over %s", peer.name, peer.proto)
+			backoff = time.Second
+			retry = nil
+			acks, acked, taken = make(chan struct{}, 1), new(uint32), 0
+			go readAcks(conn, acked, acks)
+
+			n, err := backlog.Replay(write)
+			if n > 0 { log.Printf("peer %s: replayed %d messages", peer.name, n) }
+			if err != nil {
+				disconnect(fmt.Errorf("replay failed: %v", err))
+				continue
+			}
+			// the replay may have taken longer than an ack
+			timeout = nil
+			if n > 0 { timeout = time.After(StreamAckTimeout) }
+		}
+	}
+}
+
+// readAcks takes the counts of messages acked by the server on conn,
+// only the last one is kept, acks is closed when conn fails
+func readAcks(conn net.Conn, acked *uint32, acks chan<- struct{}) {
+	defer close(acks)
+	var n uint32
+	for binary.Read(conn, binary.BigEndian, &n) == nil {
+		atomic.StoreUint32(acked, n)
+		select {
+		case acks <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ReadUDP queues the received datagrams, and counts those dropped when
+// the queue is full
+func ReadUDP(conn *net.UDPConn, packets chan<- Packet, dropped *uint64) {
+	buf := make([]byte, 2000) // max should be 1500
+	for {
+		n,addr,err := conn.ReadFromUDP(buf)
+		if err != nil { continue }
+		if n == len(buf) { fmt.Println("Warning: received very long packet") }
+		select {
+		case packets <- Packet{ip:addr.IP, buf:append([]byte(nil), buf[:n]...)}:
+		default:
+			atomic.AddUint64(dropped, 1)
+		}
+	}
+}
+
+// KernelDrops returns the datagrams dropped by the kernel on conn, its
+// receive buffer being full, from /proc/net/udp and /proc/net/udp6
+func KernelDrops(conn *net.UDPConn) (drops uint64, err error) {
+	var st syscall.Stat_t
+	if err = control(conn, func(fd int) error { return syscall.Fstat(fd, &st) }); err != nil { return }
+	inode := strconv.FormatUint(st.Ino, 10)
+
+	for _,filename := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		file, err := os.Open(filename)
+		if err != nil { continue }
+		var found bool
+		sutils.ReadLines(file, func (line string) error {
+			fields := strings.Fields(line)
+			if len(fields) < 13 || fields[9] != inode { return nil }
+			drops, err = strconv.ParseUint(fields[12], 10, 64)
+			found = true
+			return io.EOF
+		})
+		file.Close()
+		if found { return drops, err }
+	}
+	return 0, fmt.Errorf("socket not found in /proc/net/udp")
+}
+
+func ListenStream(proto string, listen string, packets chan<- Packet) error {
+	laddr, err := net.ResolveTCPAddr("tcp", listen)
+	if err != nil { return err }
+	ln, err := net.ListenTCP("tcp", laddr)
+	if err != nil { return err }
+
+	var conf *tls.Config
+	if proto == "tls" {
+		if conf, err = TLSConfig(); err != nil { return err }
+		if len(conf.Certificates) == 0 { return errors.New("tls needs -tlscert and -tlskey") }
+	}
+
+	go AcceptStream(ln, conf, packets)
+	return nil
+}
+
+// AcceptStream reads the connections accepted on ln until it is closed,
+// over tls if conf is not nil
+func AcceptStream(ln *net.TCPListener, conf *tls.Config, packets chan<- Packet) {
+	var delay time.Duration
+	for {
+		conn, err := ln.AcceptTCP()
+		if errors.Is(err, net.ErrClosed) { return }
+		if err != nil {
+			// out of file descriptors for instance, backing off like net/http
+			if delay *= 2; delay == 0 { delay = 5 * time.Millisecond }
+			if delay > time.Second { delay = time.Second }
+			log.Printf("accept %s: %v, retry in %v", ln.Addr(), err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if conf != nil {
+			go ReadStream(tls.Server(conn, conf), conn.RemoteAddr().(*net.TCPAddr).IP, packets)
+		} else {
+			go ReadStream(conn, conn.RemoteAddr().(*net.TCPAddr).IP, packets)
+		}
+	}
+}
+
+// ReadStream queues the messages of a stream connection and acks each one,
+// once it is delivered, with the count of messages received on the
+// connection. The connection is closed when a message is not delivered,
+// the sender writes it again on a new one.
+func ReadStream(conn net.Conn, ip net.IP, packets chan<- Packet) {
+	var n uint32
+	defer conn.Close()
+	done := make(chan bool, 1)
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(StreamIdleTimeout))
+		_,buf,err := ReadRecord(r)
+		if err != nil {
+			// a damaged record is not acked, the sender writes it again on
+			// a new connection
+			if err == ErrChecksum { fmt.Println("Error read stream from", ip, err) }
+			return
+		}
+		packets <- Packet{ip:ip, buf:buf, stream:true, done:done}
+		if !<-done { return }
+
+		n ++
+		conn.SetWriteDeadline(time.Now().Add(StreamWriteTimeout))
+		if err = binary.Write(conn, binary.BigEndian, n); err != nil { return }
+	}
+}
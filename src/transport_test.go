@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net"
+	"time"
+	"bytes"
+	"testing"
+	"encoding/binary"
+)
+
+func TestSplitPeer(t *testing.T) {
+	for s, want := range map[string][3]string{
+		"10.0.0.1": {"udp", "10.0.0.1", "10.0.0.1:5000"},
+		"10.0.0.1:6000": {"udp", "10.0.0.1", "10.0.0.1:6000"},
+		"tcp://collector": {"tcp", "collector", "collector:5000"},
+		"tls://collector:443": {"tls", "collector", "collector:443"},
+		"fe80::1": {"udp", "fe80::1", "[fe80::1]:5000"},
+		"[fe80::1]": {"udp", "fe80::1", "[fe80::1]:5000"},
+		"tcp://[fe80::1]:6000": {"tcp", "fe80::1", "[fe80::1]:6000"},
+	} {
+		proto, host, hostport, err := SplitPeer(s, 5000)
+		if err != nil || [3]string{proto, host, hostport} != want { t.Errorf("%q: got %s %s %s %v, want %v", s, proto, host, hostport, err, want) }
+	}
+
+	for _,s := range []string{"", "http://collector", "tcp://", ":5000", "[]"} {
+		if _,_,_,err := SplitPeer(s, 5000); err == nil { t.Errorf("%q parsed", s) }
+	}
+}
+
+func TestReadStream(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	packets := make(chan Packet, 4)
+	ip := net.ParseIP("10.0.0.1")
+	go ReadStream(server, ip, packets)
+
+	var ack uint32
+	for i := uint32(1); i <= 2; i ++ {
+		go WriteRecord(client, GetTimestamp(), []byte{4, byte(i)})
+		pkt := <-packets
+		pkt.done <- true
+		if !pkt.stream || !pkt.ip.Equal(ip) || pkt.buf[1] != byte(i) { t.Errorf("got %v", pkt) }
+		if err := binary.Read(client, binary.BigEndian, &ack); err != nil || ack != i { t.Fatalf("ack %d %v, want %d", ack, err, i) }
+	}
+
+	// a damaged record is not acked, the connection is closed
+	var record bytes.Buffer
+	WriteRecord(&record, GetTimestamp(), []byte{4, 3})
+	record.Bytes()[record.Len() - 1] ^= 0xff
+	go client.Write(record.Bytes())
+	if err := binary.Read(client, binary.BigEndian, &ack); err == nil { t.Errorf("damaged record acked %d", ack) }
+	if len(packets) != 0 { t.Errorf("damaged record queued") }
+}
+
+func TestReadStreamUndelivered(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	packets := make(chan Packet, 4)
+	go ReadStream(server, net.ParseIP("10.0.0.1"), packets)
+
+	// the record is acked once delivered
+	go WriteRecord(client, GetTimestamp(), []byte{4, 1})
+	pkt := <-packets
+	var ack uint32
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := binary.Read(client, binary.BigEndian, &ack); err == nil { t.Fatalf("acked %d before delivery", ack) }
+	client.SetReadDeadline(time.Time{})
+	pkt.done <- true
+	if err := binary.Read(client, binary.BigEndian, &ack); err != nil || ack != 1 { t.Fatalf("ack %d %v", ack, err) }
+
+	// a record not delivered closes the connection
+	go WriteRecord(client, GetTimestamp(), []byte{4, 2})
+	pkt = <-packets
+	pkt.done <- false
+	if err := binary.Read(client, binary.BigEndian, &ack); err == nil { t.Errorf("undelivered record acked %d", ack) }
+}
+
+func TestStreamReplay(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	defer ln.Close()
+
+	peer := &LoadPeer{name:"127.0.0.1", proto:"tcp", hostport:ln.Addr().String(), queue:make(chan []byte, StreamQueueSize)}
+	if err = peer.Resolve(); err != nil { t.Fatal(err) }
+	go peer.Stream(nil)
+	peer.Send([]byte{4, 1})
+
+	// the first connection reads the record and fails before the ack
+	conn, err := ln.Accept()
+	if err != nil { t.Fatal(err) }
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _,buf,err := ReadRecord(conn); err != nil || buf[1] != 1 { t.Fatalf("got % x %v", buf, err) }
+	conn.Close()
+
+	// the record is written again on the next connection
+	conn, err = ln.Accept()
+	if err != nil { t.Fatal(err) }
+	packets := make(chan Packet, 4)
+	go ReadStream(conn, net.ParseIP("127.0.0.1"), packets)
+	peer.Send([]byte{4, 2})
+
+	for i := byte(1); i <= 2; i ++ {
+		select {
+		case pkt := <-packets:
+			pkt.done <- true
+			if pkt.buf[1] != i { t.Errorf("got % x, want message %d", pkt.buf, i) }
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d not received", i)
+		}
+	}
+}
+
+func TestAcceptStream(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP:net.IPv4(127, 0, 0, 1)})
+	if err != nil { t.Fatal(err) }
+	packets := make(chan Packet, 1)
+	done := make(chan struct{})
+	go func() {
+		AcceptStream(ln, nil, packets)
+		close(done)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil { t.Fatal(err) }
+	defer conn.Close()
+	WriteRecord(conn, GetTimestamp(), []byte{4, 1})
+	pkt := <-packets
+	pkt.done <- true
+	if !pkt.stream || pkt.buf[1] != 1 { t.Errorf("got %v", pkt) }
+
+	// returns once the listener is closed
+	ln.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("still accepting after close")
+	}
+}
@@ -2,19 +2,48 @@ package main
 
 import (
 	"io"
+	"time"
 	"bytes"
 )
 
 const (
-	MessageVersion = 1
+	MessageVersion = 4
 	// subpacket codes
 	SPC_ProcLoad = 10
 	SPC_CPULoad = 11
 	SPC_MemoryLoad = 12
 	SPC_IOLoad = 13
 	SPC_NetworkLoad = 14
+	SPC_NUMALoad = 15
+	SPC_CustomMetrics = 16
+	SPC_Timing = 17
+	SPC_Status = 18
+	SPC_Identity = 19
+	SPC_Inventory = 20
 )
 
+// load subpackets, in the order they are probed and encoded
+var ProbeCodes = []uint8{SPC_ProcLoad, SPC_CPULoad, SPC_MemoryLoad, SPC_IOLoad,
+	SPC_NetworkLoad, SPC_NUMALoad, SPC_CustomMetrics}
+
+var ProbeNames = map[uint8]string{
+	SPC_ProcLoad: "proc",
+	SPC_CPULoad: "cpu",
+	SPC_MemoryLoad: "mem",
+	SPC_IOLoad: "io",
+	SPC_NetworkLoad: "net",
+	SPC_NUMALoad: "numa",
+	SPC_CustomMetrics: "custom",
+}
+
+// names of the other subpackets
+var InfoNames = map[uint8]string{
+	SPC_Timing: "timing",
+	SPC_Status: "status",
+	SPC_Identity: "identity",
+	SPC_Inventory: "inventory",
+}
+
 type Subpacket interface {
 	Encode() (spcode uint8, buf *bytes.Buffer)
 	Decode(splen uint8, r io.Reader) error
@@ -31,8 +60,16 @@ type CPUItem struct {
 	Rate_user, Rate_sys, Rate_iowait, Rate_idle uint8
 }
 
+// sampling window of the probes reporting counter deltas, the deltas are
+// scaled from the actually elapsed time to the nominal interval
+type Window struct {
+	Interval time.Duration
+	Elapsed time.Duration
+	Last time.Time
+}
+
 type CPULoad struct {
-	Interval float32
+	Window
 	Items []CPUItem
 	Current [][4]int64
 }
@@ -46,7 +83,14 @@ type DiskItem struct {
 	tps_read, tps_written, kbytes_read, kbytes_written uint32
 }
 
+// per-second view of a DiskItem
+type DiskRate struct {
+	name string
+	reads, writes, kbytes_read, kbytes_written float64
+}
+
 type IOLoad struct {
+	Window
 	Items []DiskItem
 	Current [][4]int64
 }
@@ -56,18 +100,122 @@ type InterfaceItem struct {
 	pkts_read, pkts_written, kbytes_read, kbytes_written uint32
 }
 
+// per-second view of an InterfaceItem
+type InterfaceRate struct {
+	name string
+	pkts_read, pkts_written, kbytes_read, kbytes_written float64
+}
+
 type NetworkLoad struct {
+	Window
 	Items []InterfaceItem
 	Current [][4]int64
 }
 
+type NUMAItem struct {
+	node uint8
+	memfree, filepages, anonpages uint32
+	numa_hit, numa_miss uint32
+}
+
+type NUMALoad struct {
+	Window
+	hugepages_total, hugepages_free, hugepages_rsvd uint32
+	Items []NUMAItem
+	Current [][2]int64
+}
+
+type MetricItem struct {
+	name string
+	value float64
+}
+
+type CustomLoad struct {
+	Items []MetricItem
+	Plugins []string // commands printing "name value" lines
+	Timeout time.Duration
+	Listener *MetricsListener // may be nil
+}
+
+// actual measurement window of a message, set by the sender scheduler
+type Timing struct {
+	window_ms uint32 // time since the previous message
+	delay_ms uint32 // time from the scheduled tick to the probe
+	missed uint16 // ticks skipped because the previous probe overran
+}
+
+type ProbeError struct {
+	spcode uint8
+	message string
+}
+
+// probes failed in this interval, absent when all succeeded
+type Status struct {
+	Items []ProbeError
+}
+
+type Label struct {
+	key, value string
+}
+
+type Identity struct {
+	hostname string
+	machine_id string
+	labels []Label
+}
+
+type InventoryItem struct {
+	key, value string
+}
+
+// static host information, sent at startup and then periodically
+type Inventory struct {
+	Items []InventoryItem
+}
+
 type LoadMessage struct {
 	Interval uint16
-	Timestamp uint32 // timestamp: seconds from 2010-01-01 00:00:00
+	Interval_ms uint32
+	Timestamp uint32 // timestamp: seconds from 2000-01-01 00:00:00
+	Timestamp_ms uint16
+	Boot_id uint64 // random for each run of the sender, 0 before version 3
+	Sequence uint32
+	Present map[uint8]bool // subpackets carried by the message
+
+	// sender side probe scheduling, see ParseSchedule
+	Tick int
+	Schedule map[uint8]int
+
+	// receiver clock minus sender clock, corrects the displayed timestamp
+	// if not 0, see ClockStats
+	Offset time.Duration
 
 	Proc_load ProcLoad
 	Cpu_load CPULoad
 	Mem_load MemoryLoad
 	Io_load IOLoad
 	Net_load NetworkLoad
+	Numa_load NUMALoad
+	Custom_load CustomLoad
+	Timing Timing
+	Status Status
+	Identity Identity
+	Inventory Inventory
+}
+
+func (m *LoadMessage) Subpacket(spcode uint8) Subpacket {
+	switch spcode {
+	case SPC_ProcLoad: return &m.Proc_load
+	case SPC_CPULoad: return &m.Cpu_load
+	case SPC_MemoryLoad: return &m.Mem_load
+	case SPC_IOLoad: return &m.Io_load
+	case SPC_NetworkLoad: return &m.Net_load
+	case SPC_NUMALoad: return &m.Numa_load
+	case SPC_CustomMetrics: return &m.Custom_load
+	case SPC_Timing: return &m.Timing
+	case SPC_Status: return &m.Status
+	case SPC_Identity: return &m.Identity
+	case SPC_Inventory: return &m.Inventory
+	}
+	return nil
 }
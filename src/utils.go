@@ -22,41 +22,141 @@ func GetTimestamp() uint32 {
 	return ToTimestamp(t)
 }
 
+// AlignTime returns the first multiple of interval after t, counting from
+// the unix epoch so that all hosts tick at the same moments
+func AlignTime(t time.Time, interval time.Duration) time.Time {
+	ns := t.UnixNano()
+	return time.Unix(0, ns - ns % int64(interval) + int64(interval))
+}
+
+func (m *LoadMessage) Time() time.Time {
+	return FromTimestamp(m.Timestamp).Add(time.Duration(m.Timestamp_ms) * time.Millisecond)
+}
+
+func (win *Window) PerSecond(delta uint32) float64 {
+	if win.Interval <= 0 { return 0 }
+	return float64(delta) / win.Interval.Seconds()
+}
+
+func (load *IOLoad) Rates() (rates []DiskRate) {
+	for _,item := range load.Items {
+		rates = append(rates, DiskRate{name:item.name,
+			reads:load.PerSecond(item.tps_read), writes:load.PerSecond(item.tps_written),
+			kbytes_read:load.PerSecond(item.kbytes_read), kbytes_written:load.PerSecond(item.kbytes_written)})
+	}
+	return
+}
+
+func (load *NetworkLoad) Rates() (rates []InterfaceRate) {
+	for _,item := range load.Items {
+		rates = append(rates, InterfaceRate{name:item.name,
+			pkts_read:load.PerSecond(item.pkts_read), pkts_written:load.PerSecond(item.pkts_written),
+			kbytes_read:load.PerSecond(item.kbytes_read), kbytes_written:load.PerSecond(item.kbytes_written)})
+	}
+	return
+}
+
+type Dumper interface {
+	Dump(w io.Writer)
+}
+
 func (m *LoadMessage) Dump(w io.Writer) {
-	fmt.Fprintln(w, "timestamp:", FromTimestamp(m.Timestamp).Format("20060102-150405"))
-	fmt.Fprintln(w, "interval:", m.Interval)
-	fmt.Fprintf(w, "uptime: %.2f %.2f\n", m.Proc_load.Uptime_total, m.Proc_load.Uptime_idle)
-	fmt.Fprintf(w, "loadavg: %.2f %.2f %.2f\n", m.Proc_load.Loadavg[0], m.Proc_load.Loadavg[1], m.Proc_load.Loadavg[2])
-	fmt.Fprintf(w, "procs: all %d, running %d, iowait %d, zombie %d\n", m.Proc_load.Procs_all,
-		m.Proc_load.Procs_running, m.Proc_load.Procs_iowait, m.Proc_load.Procs_zombie)
-
-	for i := 0; i < len(m.Cpu_load.Items); i ++ {
+	if m.Offset != 0 {
+		fmt.Fprintf(w, "timestamp: %s (receiver clock, sender skew %v)\n",
+			m.Time().Add(m.Offset).Format("20060102-150405.000"), -m.Offset.Round(time.Millisecond))
+	} else {
+		fmt.Fprintln(w, "timestamp:", m.Time().Format("20060102-150405.000"))
+	}
+	fmt.Fprintf(w, "interval: %dms\n", m.Interval_ms)
+	if m.Boot_id != 0 { fmt.Fprintf(w, "sequence: %d, boot %016x\n", m.Sequence, m.Boot_id) }
+	if m.Present[SPC_Identity] { m.Identity.Dump(w) }
+
+	for _,spcode := range ProbeCodes {
+		if m.Present[spcode] { m.Subpacket(spcode).(Dumper).Dump(w) }
+	}
+	if m.Present[SPC_Timing] { m.Timing.Dump(w) }
+	if m.Present[SPC_Status] { m.Status.Dump(w) }
+	if m.Present[SPC_Inventory] { m.Inventory.Dump(w) }
+}
+
+func (load *ProcLoad) Dump(w io.Writer) {
+	fmt.Fprintf(w, "uptime: %.2f %.2f\n", load.Uptime_total, load.Uptime_idle)
+	fmt.Fprintf(w, "loadavg: %.2f %.2f %.2f\n", load.Loadavg[0], load.Loadavg[1], load.Loadavg[2])
+	fmt.Fprintf(w, "procs: all %d, running %d, iowait %d, zombie %d\n", load.Procs_all,
+		load.Procs_running, load.Procs_iowait, load.Procs_zombie)
+}
+
+func (load *CPULoad) Dump(w io.Writer) {
+	for i := 0; i < len(load.Items); i ++ {
 		fmt.Fprintf(w, "cpu%d: user %.1f%%, sys %.1f%%, iowait %.1f%%, idle %.1f%%\n", i,
-			float32(m.Cpu_load.Items[i].Rate_user) / 2.55,
-			float32(m.Cpu_load.Items[i].Rate_sys) / 2.55,
-			float32(m.Cpu_load.Items[i].Rate_iowait) / 2.55,
-			float32(m.Cpu_load.Items[i].Rate_idle) / 2.55)
+			float32(load.Items[i].Rate_user) / 2.55,
+			float32(load.Items[i].Rate_sys) / 2.55,
+			float32(load.Items[i].Rate_iowait) / 2.55,
+			float32(load.Items[i].Rate_idle) / 2.55)
 	}
+}
 
+func (load *MemoryLoad) Dump(w io.Writer) {
 	fmt.Fprintf(w, "mem: free %d, buffers %d, cached %d, dirty %d, active %d\n",
-		m.Mem_load.free, m.Mem_load.buffers, m.Mem_load.cached,
-		m.Mem_load.dirty, m.Mem_load.active)
+		load.free, load.buffers, load.cached, load.dirty, load.active)
 	fmt.Fprintf(w, "mem swap: cached %d, total %d, free %d\n",
-		m.Mem_load.swapcached, m.Mem_load.swaptotal, m.Mem_load.swapfree)
+		load.swapcached, load.swaptotal, load.swapfree)
+}
+
+func (load *IOLoad) Dump(w io.Writer) {
+	for _,rate := range load.Rates() {
+		fmt.Fprintf(w, "drv %s: reads/s %.1f, kbytes_read/s %.1f, writes/s %.1f, kbytes_written/s %.1f\n",
+			rate.name, rate.reads, rate.kbytes_read, rate.writes, rate.kbytes_written)
+	}
+}
 
-	for i := 0; i < len(m.Io_load.Items); i++ {
-		fmt.Fprintf(w, "drv %s: tps_read %d, kbytes_read %d, tps_written %d, kbytes_written %d\n",
-			m.Io_load.Items[i].name,
-			m.Io_load.Items[i].tps_read, m.Io_load.Items[i].kbytes_read,
-			m.Io_load.Items[i].tps_written, m.Io_load.Items[i].kbytes_written,
-			)
+func (load *NetworkLoad) Dump(w io.Writer) {
+	for _,rate := range load.Rates() {
+		fmt.Fprintf(w, "net %s: pkts_read/s %.1f, kbytes_read/s %.1f, pkts_written/s %.1f, kbytes_written/s %.1f\n",
+			rate.name, rate.pkts_read, rate.kbytes_read, rate.pkts_written, rate.kbytes_written)
 	}
+}
 
-	for i := 0; i < len(m.Net_load.Items); i++ {
-		fmt.Fprintf(w, "net %s: pkts_read %d, kbytes_read %d, pkts_written %d, kbytes_written %d\n",
-			m.Net_load.Items[i].name,
-			m.Net_load.Items[i].pkts_read, m.Net_load.Items[i].kbytes_read,
-			m.Net_load.Items[i].pkts_written, m.Net_load.Items[i].kbytes_written,
+func (load *NUMALoad) Dump(w io.Writer) {
+	fmt.Fprintf(w, "hugepages: total %d, free %d, rsvd %d\n",
+		load.hugepages_total, load.hugepages_free, load.hugepages_rsvd)
+	for i := 0; i < len(load.Items); i++ {
+		fmt.Fprintf(w, "node%d: memfree %d, filepages %d, anonpages %d, numa_hit/s %.1f, numa_miss/s %.1f\n",
+			load.Items[i].node,
+			load.Items[i].memfree, load.Items[i].filepages, load.Items[i].anonpages,
+			load.PerSecond(load.Items[i].numa_hit), load.PerSecond(load.Items[i].numa_miss),
 		)
 	}
 }
+
+func (load *CustomLoad) Dump(w io.Writer) {
+	for i := 0; i < len(load.Items); i++ {
+		fmt.Fprintf(w, "metric %s: %g\n", load.Items[i].name, load.Items[i].value)
+	}
+}
+
+func (t *Timing) Dump(w io.Writer) {
+	fmt.Fprintf(w, "window: %dms, delay %dms, missed %d\n", t.window_ms, t.delay_ms, t.missed)
+}
+
+func (st *Status) Dump(w io.Writer) {
+	for _,item := range st.Items {
+		name := ProbeNames[item.spcode]
+		if name == "" { name = fmt.Sprintf("#%d", item.spcode) }
+		fmt.Fprintf(w, "probe %s failed: %s\n", name, item.message)
+	}
+}
+
+func (id *Identity) Dump(w io.Writer) {
+	fmt.Fprintf(w, "host: %s, machine-id %s", id.hostname, id.machine_id)
+	for _,label := range id.labels {
+		fmt.Fprintf(w, ", %s=%s", label.key, label.value)
+	}
+	fmt.Fprintln(w)
+}
+
+func (inv *Inventory) Dump(w io.Writer) {
+	for _,item := range inv.Items {
+		fmt.Fprintf(w, "inventory %s: %s\n", item.key, item.value)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"time"
+	"testing"
+)
+
+func TestAlignTime(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	for _,c := range []struct{ t time.Time; interval time.Duration; want time.Time }{
+		{base, time.Minute, base.Add(40 * time.Second)},
+		{base.Add(40 * time.Second), time.Minute, base.Add(100 * time.Second)},
+		{base.Add(1500 * time.Millisecond), 500 * time.Millisecond, base.Add(2 * time.Second)},
+		{base.Add(1), time.Second, base.Add(time.Second)},
+	} {
+		if got := AlignTime(c.t, c.interval); !got.Equal(c.want) { t.Errorf("AlignTime(%v, %v) = %v, want %v", c.t, c.interval, got, c.want) }
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	if got := FromTimestamp(ToTimestamp(now)); !got.Equal(now) { t.Errorf("got %v, want %v", got, now) }
+	if ToTimestamp(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)) != 0 { t.Errorf("epoch is not 2000-01-01") }
+}